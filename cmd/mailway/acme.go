@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+)
+
+var (
+	// ACME accounts and issued certificates, by directory
+	ACME_LOCATION = path.Join(config.ROOT_LOCATION, "acme")
+	// how long issuing a certificate can take
+	ACME_TIMEOUT = 5 * time.Minute
+	// where the HTTP-01 challenges are answered when port 80 is already
+	// taken; frontline proxies /.well-known/acme-challenge/ to it
+	ACME_CHALLENGE_PORT = 9096
+	// how long to wait for the DNS-01 record to be visible
+	DEFAULT_ACME_DNS_PROPAGATION_TIMEOUT = 5 * time.Minute
+)
+
+// acme.yml in conf.d
+type acmeConfig struct {
+	DirectoryURL string `yaml:"acme_directory_url"`
+	// PEM bundle trusted for the directory's HTTPS
+	DirectoryCA string `yaml:"acme_directory_ca"`
+	// External Account Binding, for CAs that require it; the HMAC key is
+	// base64url encoded
+	EABKeyID   string `yaml:"acme_eab_kid"`
+	EABHMACKey string `yaml:"acme_eab_hmac_key"`
+	// http-01 or dns-01, for the SMTP certificate
+	SMTPChallenge string `yaml:"acme_smtp_challenge"`
+	// executable called with present|cleanup <record> <value> to manage
+	// the DNS-01 TXT record
+	DNSHook               string        `yaml:"acme_dns_hook"`
+	DNSPropagationTimeout time.Duration `yaml:"acme_dns_propagation_timeout"`
+}
+
+func loadACMEConfig() (*acmeConfig, error) {
+	c := acmeConfig{
+		DirectoryURL:          acme.LetsEncryptURL,
+		SMTPChallenge:         "http-01",
+		DNSPropagationTimeout: DEFAULT_ACME_DNS_PROPAGATION_TIMEOUT,
+	}
+	if err := loadConf(&c); err != nil {
+		return nil, errors.Wrap(err, "could not load ACME config")
+	}
+	return &c, nil
+}
+
+// smtpSolver returns the solver configured for the SMTP certificate
+func (c *acmeConfig) smtpSolver() (acmeSolver, error) {
+	switch c.SMTPChallenge {
+	case "http-01", "":
+		return newHTTP01Solver(), nil
+	case "dns-01":
+		if c.DNSHook == "" {
+			return nil, errors.New("acme_dns_hook is required for dns-01")
+		}
+		return newDNS01Solver(c.DNSHook, c.DNSPropagationTimeout), nil
+	}
+	return nil, errors.Errorf("unknown acme_smtp_challenge %q", c.SMTPChallenge)
+}
+
+// newACMEClient returns a client registered with the configured CA. The
+// account is registered once and reused from the cache afterwards.
+func newACMEClient(ctx context.Context, conf *acmeConfig) (*acme.Client, error) {
+	cache, err := newACMECache(conf.DirectoryURL)
+	if err != nil {
+		return nil, err
+	}
+	key, err := cache.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: conf.DirectoryURL,
+	}
+	if conf.DirectoryCA != "" {
+		httpClient, err := acmeHTTPClient(conf.DirectoryCA)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = httpClient
+	}
+
+	if cache.registered() {
+		return client, nil
+	}
+	account := &acme.Account{}
+	if email := config.CurrConfig.InstanceEmail; email != "" {
+		account.Contact = []string{"mailto:" + email}
+	}
+	if conf.EABKeyID != "" {
+		hmacKey, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(conf.EABHMACKey, "="))
+		if err != nil {
+			return nil, errors.Wrap(err, "acme_eab_hmac_key is not base64url")
+		}
+		account.ExternalAccountBinding = &acme.ExternalAccountBinding{
+			KID: conf.EABKeyID,
+			Key: hmacKey,
+		}
+	}
+	log.Infof("registering ACME account with %s", conf.DirectoryURL)
+	account, err = client.Register(ctx, account, acme.AcceptTOS)
+	if err == acme.ErrAccountAlreadyExists {
+		account, err = client.GetReg(ctx, "")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not register ACME account")
+	}
+	if err := cache.saveAccount(account); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// acmeHTTPClient trusts the CA bundle on top of the system roots, for
+// directories with a private certificate such as Pebble
+func acmeHTTPClient(caPath string) (*http.Client, error) {
+	data, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read acme_directory_ca")
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("no certificate found in %s", caPath)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+// acmeHostPolicy refuses to ask certificates for anything but the instance,
+// the CA would rate limit us for nothing
+func acmeHostPolicy(domain string) error {
+	if config.CurrConfig.InstanceHostname == "" {
+		return errors.New("the instance has no hostname; run mailway setup first")
+	}
+	if !strings.EqualFold(domain, config.CurrConfig.InstanceHostname) {
+		return errors.Errorf("%s is not the instance hostname", domain)
+	}
+	return nil
+}
+
+// acmeSolver proves to the CA that we control a domain
+type acmeSolver interface {
+	challengeType() string
+	present(ctx context.Context, client *acme.Client, domain string, chal *acme.Challenge) error
+	cleanup(domain string, chal *acme.Challenge)
+	close()
+}
+
+// http01Solver answers HTTP-01 challenges on port 80, or behind frontline if
+// the port is taken
+type http01Solver struct {
+	sync.Mutex
+	responses map[string]string
+	server    *http.Server
+}
+
+func newHTTP01Solver() *http01Solver {
+	return &http01Solver{
+		responses: make(map[string]string),
+	}
+}
+
+func (s *http01Solver) challengeType() string {
+	return "http-01"
+}
+
+func (s *http01Solver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	response, ok := s.responses[r.URL.Path]
+	s.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	log.Debugf("answering ACME challenge %s", r.URL.Path)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(response))
+}
+
+func (s *http01Solver) listen() error {
+	if s.server != nil {
+		return nil
+	}
+	l, err := net.Listen("tcp", ":http")
+	if errors.Is(err, syscall.EADDRINUSE) {
+		log.Debugf("port 80 is taken; expecting frontline to proxy the challenges")
+		l, err = net.Listen("tcp", localAddr(ACME_CHALLENGE_PORT))
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not listen for ACME challenges")
+	}
+
+	s.server = &http.Server{Handler: loggingMiddleware(s)}
+	go func() {
+		if err := s.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("ACME challenge server failed: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (s *http01Solver) present(ctx context.Context, client *acme.Client, domain string, chal *acme.Challenge) error {
+	response, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return errors.Wrap(err, "could not compute challenge response")
+	}
+	if err := s.listen(); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.responses[client.HTTP01ChallengePath(chal.Token)] = response
+	return nil
+}
+
+func (s *http01Solver) cleanup(domain string, chal *acme.Challenge) {
+	s.Lock()
+	defer s.Unlock()
+	for p := range s.responses {
+		if strings.HasSuffix(p, "/"+chal.Token) {
+			delete(s.responses, p)
+		}
+	}
+}
+
+func (s *http01Solver) close() {
+	if s.server != nil {
+		s.server.Close()
+		s.server = nil
+	}
+}
+
+// dns01Solver answers DNS-01 challenges by calling a hook that manages the
+// TXT record with the DNS provider
+type dns01Solver struct {
+	hook    string
+	timeout time.Duration
+	// TXT values by challenge token, for the cleanup
+	values map[string]string
+}
+
+func newDNS01Solver(hook string, timeout time.Duration) *dns01Solver {
+	return &dns01Solver{
+		hook:    hook,
+		timeout: timeout,
+		values:  make(map[string]string),
+	}
+}
+
+func (s *dns01Solver) challengeType() string {
+	return "dns-01"
+}
+
+func (s *dns01Solver) runHook(ctx context.Context, action, record, value string) error {
+	cmd := exec.CommandContext(ctx, s.hook, action, record, value)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	log.Debugf("running: %s", cmd)
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "DNS hook failed to %s %s", action, record)
+	}
+	return nil
+}
+
+func (s *dns01Solver) present(ctx context.Context, client *acme.Client, domain string, chal *acme.Challenge) error {
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return errors.Wrap(err, "could not compute challenge record")
+	}
+	record := "_acme-challenge." + domain
+	if err := s.runHook(ctx, "present", record, value); err != nil {
+		return err
+	}
+	s.values[chal.Token] = value
+
+	// the CA gives up if it can't see the record; wait for it
+	deadline := time.Now().Add(s.timeout)
+	for time.Now().Before(deadline) {
+		values, _ := net.DefaultResolver.LookupTXT(ctx, record)
+		for _, v := range values {
+			if v == value {
+				return nil
+			}
+		}
+		log.Debugf("waiting for %s to propagate", record)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+		}
+	}
+	log.Warnf("%s not visible after %v; trying anyway", record, s.timeout)
+	return nil
+}
+
+func (s *dns01Solver) cleanup(domain string, chal *acme.Challenge) {
+	value, ok := s.values[chal.Token]
+	if !ok {
+		return
+	}
+	delete(s.values, chal.Token)
+	// also run once ctx is done, the record shouldn't be left behind
+	if err := s.runHook(context.Background(), "cleanup", "_acme-challenge."+domain, value); err != nil {
+		log.Warn(err)
+	}
+}
+
+func (s *dns01Solver) close() {}
+
+// obtainCertificate asks the CA for a certificate for the domains; it
+// returns the chain, leaf first, and its private key
+func obtainCertificate(ctx context.Context, conf *acmeConfig, domains []string,
+	solver acmeSolver) ([][]byte, *rsa.PrivateKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, ACME_TIMEOUT)
+	defer cancel()
+	defer solver.close()
+
+	for _, domain := range domains {
+		if err := acmeHostPolicy(domain); err != nil {
+			return nil, nil, err
+		}
+	}
+	cache, err := newACMECache(conf.DirectoryURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if chain, key := cache.certificate(domains); chain != nil {
+		log.Infof("reusing the cached certificate for %s", strings.Join(domains, ", "))
+		return chain, key, nil
+	}
+
+	client, err := newACMEClient(ctx, conf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create order")
+	}
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "could not get authorization")
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+
+		var chal *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == solver.challengeType() {
+				chal = c
+				break
+			}
+		}
+		domain := authz.Identifier.Value
+		if chal == nil {
+			return nil, nil, errors.Errorf("no %s challenge offered for %s",
+				solver.challengeType(), domain)
+		}
+
+		// the record might be there even if present was interrupted
+		defer solver.cleanup(domain, chal)
+		if err := solver.present(ctx, client, domain, chal); err != nil {
+			return nil, nil, err
+		}
+		if _, err := client.Accept(ctx, chal); err != nil {
+			return nil, nil, errors.Wrapf(err, "could not accept challenge for %s", domain)
+		}
+		if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+			return nil, nil, errors.Wrapf(err, "authorization failed for %s", domain)
+		}
+		log.Infof("%s authorized", domain)
+	}
+
+	if _, err := client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, nil, errors.Wrap(err, "order failed")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate RSA key")
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create CSR")
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not get certificate")
+	}
+	if err := cache.saveCertificate(domains, chain, key); err != nil {
+		// the certificate is still good to use
+		log.Warn(err)
+	}
+	return chain, key, nil
+}
+
+// saveCertPair replaces the certificate and its key. Both are written next
+// to their destination first so that nginx never reads half a file.
+func saveCertPair(certPath, keyPath string, chain [][]byte, key *rsa.PrivateKey) error {
+	for _, dir := range []string{path.Dir(certPath), path.Dir(keyPath)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrapf(err, "could not create %s", dir)
+		}
+	}
+	if err := saveCert(certPath+".tmp", chain); err != nil {
+		return err
+	}
+	// a leftover from an interrupted run could have another mode
+	if err := os.Remove(keyPath + ".tmp"); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not remove stale private key")
+	}
+	if err := savePrivateKey(keyPath+".tmp", key, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(keyPath+".tmp", keyPath); err != nil {
+		return errors.Wrap(err, "could not replace private key")
+	}
+	if err := os.Rename(certPath+".tmp", certPath); err != nil {
+		return errors.Wrap(err, "could not replace certificate")
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+)
+
+// acmeCache keeps the account and the certificates issued by an ACME
+// directory, so that we don't register or ask certificates on every run
+type acmeCache struct {
+	dir string
+}
+
+func newACMECache(directoryURL string) (*acmeCache, error) {
+	u, err := url.Parse(directoryURL)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf("invalid ACME directory URL %q", directoryURL)
+	}
+	// staging and production directories live on different hosts
+	name := strings.Replace(u.Host, ":", "_", -1)
+	return &acmeCache{dir: path.Join(ACME_LOCATION, name)}, nil
+}
+
+func (c *acmeCache) accountKey() (crypto.Signer, error) {
+	keyPath := path.Join(c.dir, "account.key")
+	data, err := ioutil.ReadFile(keyPath)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.Errorf("%s is not in PEM format", keyPath)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse ACME account key")
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "could not read ACME account key")
+	}
+
+	log.Infof("generating ACME account key %s", keyPath)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate ACME account key")
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not encode ACME account key")
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "could not create %s", c.dir)
+	}
+	data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(keyPath, data, 0600); err != nil {
+		return nil, errors.Wrap(err, "could not save ACME account key")
+	}
+	return key, nil
+}
+
+func (c *acmeCache) accountPath() string {
+	return path.Join(c.dir, "account.json")
+}
+
+// registered reports whether the account key is known to the CA. Remove
+// the directory to register again, for example after resetting Pebble.
+func (c *acmeCache) registered() bool {
+	_, err := os.Stat(c.accountPath())
+	return err == nil
+}
+
+func (c *acmeCache) saveAccount(account *acme.Account) error {
+	data, err := json.MarshalIndent(account, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not encode ACME account")
+	}
+	if err := ioutil.WriteFile(c.accountPath(), data, 0600); err != nil {
+		return errors.Wrap(err, "could not save ACME account")
+	}
+	return nil
+}
+
+func (c *acmeCache) certPaths(domains []string) (string, string) {
+	dir := path.Join(c.dir, "certs", strings.ToLower(domains[0]))
+	return path.Join(dir, "fullchain.pem"), path.Join(dir, "privkey.pem")
+}
+
+// certificate returns the cached certificate for the domains, if it covers
+// all of them and isn't due for renewal
+func (c *acmeCache) certificate(domains []string) ([][]byte, *rsa.PrivateKey) {
+	certPath, keyPath := c.certPaths(domains)
+	certData, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, nil
+	}
+	keyData, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil
+	}
+
+	var chain [][]byte
+	for block, rest := pem.Decode(certData); block != nil; block, rest = pem.Decode(rest) {
+		chain = append(chain, block.Bytes)
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		log.Debugf("ignoring cached %s: %s", certPath, err)
+		return nil, nil
+	}
+	for _, domain := range domains {
+		if err := leaf.VerifyHostname(domain); err != nil {
+			log.Debugf("ignoring cached %s: %s", certPath, err)
+			return nil, nil
+		}
+	}
+	if time.Until(leaf.NotAfter) < CERT_RENEW_BEFORE {
+		return nil, nil
+	}
+
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, nil
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		log.Debugf("ignoring cached %s: %s", keyPath, err)
+		return nil, nil
+	}
+	pub, ok := leaf.PublicKey.(*rsa.PublicKey)
+	if !ok || pub.N.Cmp(key.N) != 0 || pub.E != key.E {
+		log.Debugf("ignoring cached %s: key doesn't match", certPath)
+		return nil, nil
+	}
+	return chain, key
+}
+
+func (c *acmeCache) saveCertificate(domains []string, chain [][]byte, key *rsa.PrivateKey) error {
+	certPath, keyPath := c.certPaths(domains)
+	if err := saveCertPair(certPath, keyPath, chain, key); err != nil {
+		return errors.Wrap(err, "could not cache certificate")
+	}
+	return nil
+}
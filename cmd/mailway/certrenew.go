@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	CERT_CHECK_INTERVAL = 12 * time.Hour
+	// certificates are renewed when they expire in less than that
+	CERT_RENEW_BEFORE = 30 * 24 * time.Hour
+)
+
+// reloadFrontline makes nginx read its certificates again; existing
+// connections are served by the old workers until they close
+func reloadFrontline() error {
+	cmd := exec.Command("systemctl", "reload", "frontline")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrap(err, "could not reload frontline")
+	}
+	return nil
+}
+
+// issueHTTPCert obtains the certificate for the HTTPS endpoint of frontline
+func issueHTTPCert(ctx context.Context) error {
+	conf, err := loadACMEConfig()
+	if err != nil {
+		return err
+	}
+	hostname := config.CurrConfig.InstanceHostname
+	log.Infof("asking a certificate for %s; this could take a minute or two", hostname)
+	chain, key, err := obtainCertificate(ctx, conf, []string{hostname}, newHTTP01Solver())
+	if err != nil {
+		return err
+	}
+	if err := saveCertPair(httpCertPath(), httpKeyPath(), chain, key); err != nil {
+		return errors.Wrap(err, "could not save certificate")
+	}
+	log.Infof("certificate for %s saved in %s", hostname, httpCertPath())
+	return nil
+}
+
+// issueSMTPCert obtains the certificate used by frontline for STARTTLS and
+// SMTPS, with the challenge configured in acme.yml
+func issueSMTPCert(ctx context.Context) error {
+	conf, err := loadACMEConfig()
+	if err != nil {
+		return err
+	}
+	solver, err := conf.smtpSolver()
+	if err != nil {
+		return err
+	}
+
+	hostname := config.CurrConfig.InstanceHostname
+	log.Infof("asking a SMTP certificate for %s using %s; this could take a minute or two",
+		hostname, solver.challengeType())
+	chain, key, err := obtainCertificate(ctx, conf, []string{hostname}, solver)
+	if err != nil {
+		return err
+	}
+	if err := saveCertPair(smtpCertPath(), smtpKeyPath(), chain, key); err != nil {
+		return errors.Wrap(err, "could not save certificate")
+	}
+	log.Infof("certificate for %s saved in %s", hostname, smtpCertPath())
+	return nil
+}
+
+// needsRenewal reports whether the certificate expires soon
+func needsRenewal(certPath string) (bool, error) {
+	cert, err := readCertificate(certPath)
+	if err != nil {
+		return false, err
+	}
+	left := time.Until(cert.NotAfter)
+	log.Debugf("%s expires in %v", certPath, left.Round(time.Hour))
+	return left < CERT_RENEW_BEFORE, nil
+}
+
+// renewCert issues the certificate again if it expires soon
+func renewCert(ctx context.Context, certPath string, issue func(context.Context) error) error {
+	renew, err := needsRenewal(certPath)
+	if os.IsNotExist(errors.Cause(err)) {
+		// not issued yet; that's mailway setup's job
+		log.Debugf("no certificate at %s", certPath)
+		return nil
+	}
+	if err != nil || !renew {
+		return err
+	}
+
+	log.Infof("%s expires soon; renewing", certPath)
+	if err := issue(ctx); err != nil {
+		return err
+	}
+	return reloadFrontline()
+}
+
+// superviseCertificates renews the certificates ahead of their expiry until
+// ctx is done
+func superviseCertificates(ctx context.Context) {
+	log.Info("certificate watcher running")
+	ticker := time.NewTicker(CERT_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		if !config.CurrConfig.IsInstanceLocal() {
+			if err := renewCert(ctx, httpCertPath(), issueHTTPCert); err != nil {
+				log.Errorf("failed to renew HTTPS certificate: %s", err)
+			}
+		}
+		if err := renewCert(ctx, smtpCertPath(), issueSMTPCert); err != nil {
+			log.Errorf("failed to renew SMTP certificate: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	DKIM_CERT_PATH = "/etc/ssl/certs/mailway-dkim.pem"
+)
+
+func httpCertPath() string {
+	return fmt.Sprintf("/etc/ssl/certs/http-%s.pem", config.CurrConfig.InstanceHostname)
+}
+
+func httpKeyPath() string {
+	return fmt.Sprintf("/etc/ssl/private/http-%s.pem", config.CurrConfig.InstanceHostname)
+}
+
+// certificate for the frontline SMTP, obtained over ACME; it keeps the
+// certbot layout that older instances already have
+func smtpCertPath() string {
+	return fmt.Sprintf("/etc/letsencrypt/live/smtp-%s/fullchain.pem", config.CurrConfig.InstanceHostname)
+}
+
+func smtpKeyPath() string {
+	return fmt.Sprintf("/etc/letsencrypt/live/smtp-%s/privkey.pem", config.CurrConfig.InstanceHostname)
+}
+
+// readCertificate returns the first certificate of a PEM file
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read certificate")
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.Errorf("no certificate in %s", path)
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse certificate")
+		}
+		return cert, nil
+	}
+}
+
+// checkCert returns why frontline can't use the certificate for the
+// instance, if it can't
+func checkCert(certPath, keyPath string) error {
+	if !fileExists(keyPath) {
+		return errors.Errorf("%s is missing", keyPath)
+	}
+	cert, err := readCertificate(certPath)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return errors.Errorf("%s is only valid from %s to %s", certPath,
+			cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	}
+	if err := cert.VerifyHostname(config.CurrConfig.InstanceHostname); err != nil {
+		return errors.Wrapf(err, "%s doesn't match the instance", certPath)
+	}
+	return nil
+}
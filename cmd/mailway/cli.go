@@ -7,7 +7,11 @@ import (
 )
 
 var (
-	isLocalSetup bool
+	isLocalSetup  bool
+	outputJSON    bool
+	skipConfirm   bool
+	recoverOpts   recoverOptions
+	frontlineOpts frontlineOptions
 
 	rootCmd = &cobra.Command{
 		Use:   "mailway",
@@ -29,7 +33,7 @@ var (
 		Short: "Mailway instance setup secure inbound SMTP",
 		Args:  cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if err := setupSecureSmtp(); err != nil {
+			if err := setupSecureSmtp(frontlineOpts); err != nil {
 				log.Fatal(err)
 			}
 			return nil
@@ -40,11 +44,13 @@ var (
 		Short: "Mailway instance generate the frontline NGINX configuration",
 		Args:  cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if err := generateHTTPCert(); err != nil {
-				log.Error(err)
+			if !frontlineOpts.DryRun {
+				if err := generateHTTPCert(); err != nil {
+					log.Error(err)
+				}
 			}
-			if err := generateFrontlineConf(); err != nil {
-				log.Error(err)
+			if err := generateFrontlineConf(frontlineOpts); err != nil {
+				log.Fatal(err)
 			}
 			return nil
 		},
@@ -83,7 +89,13 @@ var (
 		Short: "Get Mailway services status",
 		Args:  cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			services("restart")
+			services("status")
+			if err := queueStatus(); err != nil {
+				return errors.Wrap(err, "could not get queue status")
+			}
+			if err := healthStatus(); err != nil {
+				return errors.Wrap(err, "could not get services health")
+			}
 			return nil
 		},
 	}
@@ -119,12 +131,150 @@ var (
 		},
 	}
 	recoverCmd = &cobra.Command{
-		Use:   "recover [file]",
-		Short: "Run Mailway supervisor",
+		Use:   "recover [file|dir|glob...]",
+		Short: "Send buffered emails back into Mailway",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if err := recoverEmail(args[0]); err != nil {
-				return errors.Wrap(err, "could not recover email")
+			if err := recoverFiles(args, recoverOpts); err != nil {
+				return errors.Wrap(err, "could not recover emails")
+			}
+			return nil
+		},
+	}
+	queueCmd = &cobra.Command{
+		Use:   "queue",
+		Short: "Inspect Mailway retry queue",
+	}
+	queueListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List emails waiting to be retried",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := queueList(outputJSON); err != nil {
+				return errors.Wrap(err, "could not list queue")
+			}
+			return nil
+		},
+	}
+	queueFlushCmd = &cobra.Command{
+		Use:   "flush [id...]",
+		Short: "Retry queued emails now; all of them if no id is given",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := queueFlush(args); err != nil {
+				return errors.Wrap(err, "could not flush queue")
+			}
+			return nil
+		},
+	}
+	queueHoldCmd = &cobra.Command{
+		Use:   "hold [id...]",
+		Short: "Hold queued emails so they are not retried",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := queueHold(args); err != nil {
+				return errors.Wrap(err, "could not hold emails")
+			}
+			return nil
+		},
+	}
+	queueReleaseCmd = &cobra.Command{
+		Use:   "release [id...]",
+		Short: "Release held emails; all of them if no id is given",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := queueRelease(args); err != nil {
+				return errors.Wrap(err, "could not release emails")
+			}
+			return nil
+		},
+	}
+	queueDeleteCmd = &cobra.Command{
+		Use:   "delete [id...]",
+		Short: "Delete queued emails",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := queueDelete(args, skipConfirm); err != nil {
+				return errors.Wrap(err, "could not delete emails")
+			}
+			return nil
+		},
+	}
+	queueDeadCmd = &cobra.Command{
+		Use:   "dead",
+		Short: "Manage emails that exhausted their retries",
+	}
+	queueDeadListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List dead letters",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := parkedList(DEAD_LETTER_LOCATION, outputJSON); err != nil {
+				return errors.Wrap(err, "could not list dead letters")
+			}
+			return nil
+		},
+	}
+	queueDeadRequeueCmd = &cobra.Command{
+		Use:   "requeue [id...]",
+		Short: "Put dead letters back into the queue; all of them if no id is given",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := parkedRequeue(DEAD_LETTER_LOCATION, args); err != nil {
+				return errors.Wrap(err, "could not requeue dead letters")
+			}
+			return nil
+		},
+	}
+	queueDeadPurgeCmd = &cobra.Command{
+		Use:   "purge [id...]",
+		Short: "Delete dead letters; all of them if no id is given",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := parkedPurge(DEAD_LETTER_LOCATION, args, skipConfirm); err != nil {
+				return errors.Wrap(err, "could not purge dead letters")
+			}
+			return nil
+		},
+	}
+	queueQuarantineCmd = &cobra.Command{
+		Use:   "quarantine",
+		Short: "Manage emails the retrier can't process",
+	}
+	queueQuarantineListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List quarantined emails",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := parkedList(QUARANTINE_LOCATION, outputJSON); err != nil {
+				return errors.Wrap(err, "could not list quarantined emails")
+			}
+			return nil
+		},
+	}
+	queueQuarantineRequeueCmd = &cobra.Command{
+		Use:   "requeue [id...]",
+		Short: "Put quarantined emails back into the queue; all of them if no id is given",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := parkedRequeue(QUARANTINE_LOCATION, args); err != nil {
+				return errors.Wrap(err, "could not requeue quarantined emails")
+			}
+			return nil
+		},
+	}
+	queueQuarantinePurgeCmd = &cobra.Command{
+		Use:   "purge [id...]",
+		Short: "Delete quarantined emails; all of them if no id is given",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := parkedPurge(QUARANTINE_LOCATION, args, skipConfirm); err != nil {
+				return errors.Wrap(err, "could not purge quarantined emails")
+			}
+			return nil
+		},
+	}
+	queueShowCmd = &cobra.Command{
+		Use:   "show [id]",
+		Short: "Print a queued email",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := queueShow(args[0], outputJSON); err != nil {
+				return errors.Wrap(err, "could not show email")
 			}
 			return nil
 		},
@@ -134,6 +284,41 @@ var (
 func init() {
 	setupCmd.Flags().BoolVar(&isLocalSetup, "local", false,
 		"Don't connect with Mailway API, run in local mode")
+	setupSecureSMTPCmd.Flags().BoolVar(&frontlineOpts.Force, "force", false,
+		"Replace the frontline configuration even if it was edited by hand")
+	generateFrontlineConfigCmd.Flags().BoolVar(&frontlineOpts.Force, "force", false,
+		"Replace the configuration even if it was edited by hand")
+	generateFrontlineConfigCmd.Flags().BoolVar(&frontlineOpts.DryRun, "dry-run", false,
+		"Show and validate the changes without applying them")
+	recoverCmd.Flags().BoolVar(&recoverOpts.DryRun, "dry-run", false,
+		"Print what would be sent where without sending")
+	recoverCmd.Flags().StringVar(&recoverOpts.Via, "via", "",
+		"Send to this service instead of the one in Mw-Int-Via")
+	recoverCmd.Flags().BoolVar(&recoverOpts.Keep, "keep", false,
+		"Keep the files once sent")
+	queueCmd.PersistentFlags().BoolVar(&outputJSON, "json", false,
+		"Print output as JSON")
+
+	queueCmd.AddCommand(queueListCmd)
+	queueCmd.AddCommand(queueShowCmd)
+	queueDeleteCmd.Flags().BoolVarP(&skipConfirm, "yes", "y", false,
+		"Don't ask for confirmation")
+	queueCmd.AddCommand(queueFlushCmd)
+	queueCmd.AddCommand(queueHoldCmd)
+	queueCmd.AddCommand(queueReleaseCmd)
+	queueCmd.AddCommand(queueDeleteCmd)
+	queueDeadPurgeCmd.Flags().BoolVarP(&skipConfirm, "yes", "y", false,
+		"Don't ask for confirmation")
+	queueDeadCmd.AddCommand(queueDeadListCmd)
+	queueDeadCmd.AddCommand(queueDeadRequeueCmd)
+	queueDeadCmd.AddCommand(queueDeadPurgeCmd)
+	queueCmd.AddCommand(queueDeadCmd)
+	queueQuarantinePurgeCmd.Flags().BoolVarP(&skipConfirm, "yes", "y", false,
+		"Don't ask for confirmation")
+	queueQuarantineCmd.AddCommand(queueQuarantineListCmd)
+	queueQuarantineCmd.AddCommand(queueQuarantineRequeueCmd)
+	queueQuarantineCmd.AddCommand(queueQuarantinePurgeCmd)
+	queueCmd.AddCommand(queueQuarantineCmd)
 
 	rootCmd.AddCommand(setupCmd)
 	rootCmd.AddCommand(setupSecureSMTPCmd)
@@ -146,4 +331,5 @@ func init() {
 	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(supervisorCmd)
 	rootCmd.AddCommand(recoverCmd)
+	rootCmd.AddCommand(queueCmd)
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+
+	"github.com/mailway-app/config"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// loadConf decodes the conf.d files into v. It reads the same files as the
+// config package, so keys specific to the mailway CLI can live alongside the
+// shared ones.
+func loadConf(v interface{}) error {
+	files, err := ioutil.ReadDir(config.CONFIG_LOCATION)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", config.CONFIG_LOCATION)
+	}
+
+	data := []byte{}
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if ext != ".yml" && ext != ".yaml" {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(config.CONFIG_LOCATION, file.Name()))
+		if err != nil {
+			return errors.Wrap(err, "could not read config")
+		}
+		data = append(data, content...)
+		data = append(data, '\n')
+	}
+
+	if err := yaml.Unmarshal(data, v); err != nil {
+		return errors.Wrap(err, "failed to parse")
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/manifoldco/promptui"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// emails the retrier gave up on
+	DEAD_LETTER_LOCATION = path.Join(config.RUNTIME_LOCATION, "dead")
+	// emails the retrier can't process
+	QUARANTINE_LOCATION = path.Join(config.RUNTIME_LOCATION, "quarantine")
+)
+
+const (
+	PARKED_REASON_EXT = ".reason"
+)
+
+// email taken out of the retry queue, either as dead letter or in quarantine
+type parkedEmail struct {
+	Id       string    `json:"id"`
+	Path     string    `json:"path"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Via      string    `json:"via"`
+	ParkedAt time.Time `json:"parked_at"`
+	Reason   string    `json:"reason"`
+}
+
+func parkedPath(dir string, id string) (string, error) {
+	if id == "" || filepath.Base(id) != id || strings.HasSuffix(id, PARKED_REASON_EXT) {
+		return "", errors.Errorf("invalid id: %s", id)
+	}
+	abspath := path.Join(dir, id)
+	if !fileExists(abspath) {
+		return "", errors.Errorf("%s not found in %s", id, dir)
+	}
+	return abspath, nil
+}
+
+// parkEmail takes a queued email out of the retry queue and records why. The
+// caller must hold the lock on the file.
+func parkEmail(abspath string, dir string, reason string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "could not create %s", dir)
+	}
+
+	id := filepath.Base(abspath)
+	dest := path.Join(dir, id)
+	err := ioutil.WriteFile(dest+PARKED_REASON_EXT, []byte(reason+"\n"), 0644)
+	if err != nil {
+		return errors.Wrap(err, "could not write reason file")
+	}
+	if err := os.Rename(abspath, dest); err != nil {
+		return errors.Wrap(err, "could not move file")
+	}
+	log.Warnf("%s moved to %s: %s", id, dir, reason)
+	return nil
+}
+
+func moveToDeadLetter(abspath string, reason string) error {
+	return parkEmail(abspath, DEAD_LETTER_LOCATION, reason)
+}
+
+func moveToQuarantine(abspath string, reason string) error {
+	return parkEmail(abspath, QUARANTINE_LOCATION, reason)
+}
+
+func readParkedEmail(dir string, file os.FileInfo) parkedEmail {
+	abspath := path.Join(dir, file.Name())
+	email := parkedEmail{
+		Id:       file.Name(),
+		Path:     abspath,
+		ParkedAt: file.ModTime(),
+	}
+
+	reason, err := ioutil.ReadFile(abspath + PARKED_REASON_EXT)
+	if err != nil {
+		email.Reason = fmt.Sprintf("unknown: %s", err)
+	} else {
+		email.Reason = strings.TrimSpace(string(reason))
+	}
+	if info, err := os.Stat(abspath + PARKED_REASON_EXT); err == nil {
+		email.ParkedAt = info.ModTime()
+	}
+
+	data, err := ioutil.ReadFile(abspath)
+	if err != nil {
+		return email
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return email
+	}
+	email.From = msg.Header.Get("Mw-Int-Mail-From")
+	email.To = strings.Join(emailRecipients(msg.Header), ", ")
+	email.Via = msg.Header.Get("Mw-Int-Via")
+	return email
+}
+
+func listParked(dir string) ([]parkedEmail, error) {
+	emails := make([]parkedEmail, 0)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return emails, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", dir)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || strings.HasSuffix(file.Name(), PARKED_REASON_EXT) {
+			continue
+		}
+		emails = append(emails, readParkedEmail(dir, file))
+	}
+
+	sort.Slice(emails, func(i, j int) bool {
+		return emails[i].ParkedAt.Before(emails[j].ParkedAt)
+	})
+	return emails, nil
+}
+
+func parkedIds(dir string, ids []string) ([]string, error) {
+	if len(ids) > 0 {
+		return ids, nil
+	}
+	emails, err := listParked(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, email := range emails {
+		ids = append(ids, email.Id)
+	}
+	return ids, nil
+}
+
+func parkedList(dir string, asJSON bool) error {
+	emails, err := listParked(dir)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(emails)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFROM\tTO\tVIA\tSINCE\tREASON")
+	for _, email := range emails {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", email.Id, email.From,
+			email.To, email.Via, email.ParkedAt.Format(time.RFC3339), email.Reason)
+	}
+	return w.Flush()
+}
+
+// parkedRequeue puts parked emails back into the queue and retries them
+// immediately
+func parkedRequeue(dir string, ids []string) error {
+	defer smtpSessions.closeIdle(0)
+
+	ids, err := parkedIds(dir, ids)
+	if err != nil {
+		return err
+	}
+	retryConf, err := loadRetryConfig()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, id := range ids {
+		src, err := parkedPath(dir, id)
+		if err != nil {
+			log.Error(err)
+			failed++
+			continue
+		}
+		dest := path.Join(config.RUNTIME_LOCATION, id)
+		if err := os.Rename(src, dest); err != nil {
+			log.Errorf("could not requeue %s: %s", id, err)
+			failed++
+			continue
+		}
+		if err := os.Remove(src + PARKED_REASON_EXT); err != nil && !os.IsNotExist(err) {
+			log.Warnf("could not delete reason file: %s", err)
+		}
+		// start over with a fresh retry history
+		if err := deleteRetryState(id); err != nil {
+			log.Warn(err)
+		}
+
+		log.Infof("%s requeued; retrying now", id)
+		outcome, err := retryEmail(dest, retryConf)
+		if err != nil {
+			log.Errorf("failed to retry %s: %s", id, err)
+			failed++
+		} else if outcome != retrySent {
+			log.Errorf("%s was %s again", id, outcome)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("%d email(s) failed to requeue", failed)
+	}
+	return nil
+}
+
+func parkedPurge(dir string, ids []string, skipConfirm bool) error {
+	ids, err := parkedIds(dir, ids)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if !skipConfirm {
+		prompt := promptui.Prompt{
+			Label:     fmt.Sprintf("Purge %d email(s) from %s", len(ids), dir),
+			IsConfirm: true,
+		}
+		if _, err := prompt.Run(); err != nil {
+			return errors.New("purge aborted")
+		}
+	}
+
+	for _, id := range ids {
+		abspath, err := parkedPath(dir, id)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(abspath); err != nil {
+			return errors.Wrap(err, "could not delete file")
+		}
+		if err := os.Remove(abspath + PARKED_REASON_EXT); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "could not delete reason file")
+		}
+		if err := deleteRetryState(id); err != nil {
+			log.Warn(err)
+		}
+		log.Infof("%s purged", id)
+	}
+	return nil
+}
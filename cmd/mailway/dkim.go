@@ -38,7 +38,7 @@ func getDNSKey(pubKeyPath string) ([]byte, error) {
 }
 
 func generateDKIM() ([]byte, error) {
-	certPath := "/etc/ssl/certs/mailway-dkim.pem"
+	certPath := DKIM_CERT_PATH
 	privPath := config.CurrConfig.OutDKIMPath
 
 	if fileExists(certPath) || fileExists(privPath) {
@@ -60,7 +60,7 @@ func generateDKIM() ([]byte, error) {
 	}
 
 	// private key
-	if err := savePrivateKey(privPath, key); err != nil {
+	if err := savePrivateKey(privPath, key, 0600); err != nil {
 		return []byte{}, errors.Wrap(err, "could not save private key")
 	}
 
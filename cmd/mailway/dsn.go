@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	enhancedStatusRe = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})\b`)
+)
+
+// deliveryFailure describes why an email was given up on and is used to
+// build the delivery status notification sent back to the sender
+type deliveryFailure struct {
+	Recipient string
+	// RFC 3463 enhanced status code
+	Status string
+	// SMTP reply from the remote service, if any
+	Diagnostic string
+	Reason     string
+}
+
+// permanentError is returned when the local service rejected the email with
+// a 5xx reply; retrying would not help
+type permanentError struct {
+	Code int
+	Msg  string
+	// the sender was already notified
+	notified bool
+}
+
+func (e *permanentError) Error() string {
+	return fmt.Sprintf("permanent failure: %d %s", e.Code, e.Msg)
+}
+
+func (e *permanentError) failure() deliveryFailure {
+	status := "5.0.0"
+	if m := enhancedStatusRe.FindStringSubmatch(e.Msg); m != nil {
+		status = m[1]
+	}
+	return deliveryFailure{
+		Status:     status,
+		Diagnostic: fmt.Sprintf("smtp; %d %s", e.Code, e.Msg),
+		Reason:     e.Error(),
+	}
+}
+
+func retriesExhaustedFailure(reason string) deliveryFailure {
+	return deliveryFailure{
+		Status: "4.4.7",
+		Reason: reason,
+	}
+}
+
+// originalHeaders returns the raw header block of the email without the
+// internal Mw-Int-* headers
+func originalHeaders(data []byte) []byte {
+	var out bytes.Buffer
+	skipping := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line == "\r" {
+			break
+		}
+		isContinuation := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+		if !isContinuation {
+			skipping = strings.HasPrefix(strings.ToLower(line), "mw-int-")
+		}
+		if skipping {
+			continue
+		}
+		out.WriteString(strings.TrimRight(line, "\r"))
+		out.WriteString("\r\n")
+	}
+	return out.Bytes()
+}
+
+// forAll applies the failure to every recipient of the email
+func (f deliveryFailure) forAll(header mail.Header) []deliveryFailure {
+	failures := make([]deliveryFailure, 0)
+	for _, rcpt := range emailRecipients(header) {
+		f.Recipient = rcpt
+		failures = append(failures, f)
+	}
+	return failures
+}
+
+func buildDSN(data []byte, msg *mail.Message, failures []deliveryFailure) ([]byte, error) {
+	hostname := config.CurrConfig.InstanceHostname
+	from := msg.Header.Get("Mw-Int-Mail-From")
+	now := time.Now()
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	fmt.Fprintf(&body, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", hostname)
+	fmt.Fprintf(&body, "To: <%s>\r\n", from)
+	fmt.Fprintf(&body, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&body, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "Message-ID: <%d.dsn@%s>\r\n", now.UnixNano(), hostname)
+	fmt.Fprintf(&body, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&body, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&body, "Content-Type: multipart/report; report-type=delivery-status;\r\n")
+	fmt.Fprintf(&body, "\tboundary=\"%s\"\r\n", w.Boundary())
+	fmt.Fprintf(&body, "\r\n")
+
+	// human readable explanation
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create text part")
+	}
+	fmt.Fprintf(part, "This is the mail system at host %s.\r\n\r\n", hostname)
+	fmt.Fprintf(part, "Your message could not be delivered to the following recipients.\r\n")
+	for _, failure := range failures {
+		fmt.Fprintf(part, "\r\n<%s>: %s\r\n", failure.Recipient, failure.Reason)
+	}
+
+	// machine readable status
+	part, err = w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"message/delivery-status"},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create status part")
+	}
+	fmt.Fprintf(part, "Reporting-MTA: dns; %s\r\n", hostname)
+	if date, err := msg.Header.Date(); err == nil {
+		fmt.Fprintf(part, "Arrival-Date: %s\r\n", date.Format(time.RFC1123Z))
+	}
+	for _, failure := range failures {
+		fmt.Fprintf(part, "\r\n")
+		fmt.Fprintf(part, "Final-Recipient: rfc822; %s\r\n", failure.Recipient)
+		fmt.Fprintf(part, "Action: failed\r\n")
+		fmt.Fprintf(part, "Status: %s\r\n", failure.Status)
+		if failure.Diagnostic != "" {
+			fmt.Fprintf(part, "Diagnostic-Code: %s\r\n", failure.Diagnostic)
+		}
+		fmt.Fprintf(part, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+	}
+
+	// original message headers
+	part, err = w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/rfc822-headers"},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create headers part")
+	}
+	if _, err := part.Write(originalHeaders(data)); err != nil {
+		return nil, errors.Wrap(err, "could not write headers part")
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, "could not close multipart")
+	}
+	return body.Bytes(), nil
+}
+
+// sendDSN notifies the sender that their email won't be delivered to the
+// failed recipients
+func sendDSN(data []byte, failures []deliveryFailure) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "could not read message")
+	}
+
+	from := msg.Header.Get("Mw-Int-Mail-From")
+	// never bounce a bounce or mail without a return path
+	if from == "" || from == "<>" {
+		log.Debug("null sender; not sending DSN")
+		return nil
+	}
+	if v := msg.Header.Get("Auto-Submitted"); v != "" && v != "no" {
+		log.Debug("auto-submitted email; not sending DSN")
+		return nil
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	dsn, err := buildDSN(data, msg, failures)
+	if err != nil {
+		return errors.Wrap(err, "could not build DSN")
+	}
+
+	if err := sendMailout("", []string{from}, dsn); err != nil {
+		return errors.Wrap(err, "could not send DSN")
+	}
+	log.Infof("DSN sent to %s", from)
+	return nil
+}
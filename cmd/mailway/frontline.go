@@ -1,43 +1,296 @@
 package main
 
 import (
-	"crypto/tls"
-	"fmt"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"os/exec"
+	"path"
+	"strings"
 	"text/template"
 
 	"github.com/mailway-app/config"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/acme/autocert"
 )
 
-func generateFrontlineConf() error {
-	file := "/etc/mailway/frontline/nginx.conf"
-	if fileExists(file) {
-		log.Warnf("%s already exists; skipping frontline config generation.", file)
-		return nil
+var (
+	FRONTLINE_LOCATION = path.Join(config.ROOT_LOCATION, "frontline")
+	FRONTLINE_CONF     = path.Join(FRONTLINE_LOCATION, "nginx.conf")
+	FRONTLINE_TEMPLATE = path.Join(FRONTLINE_LOCATION, "nginx.conf.tmpl")
+	FRONTLINE_NGINX    = "/usr/local/sbin/frontline-nginx"
+	// directories of *.conf snippets included by the default template, in
+	// the mail server blocks, the mail block, the http block and the HTTPS
+	// server block
+	FRONTLINE_DROPINS = []string{"mail-server.d", "mail.d", "http.d", "http-server.d"}
+)
+
+// frontline.yml in conf.d
+type frontlineConfig struct {
+	// template used instead of nginx.conf.tmpl
+	Template string `yaml:"frontline_template"`
+	// offer STARTTLS on port_frontline_smtp
+	STARTTLS bool `yaml:"frontline_starttls"`
+	// listen on port_frontline_smtps for submission, STARTTLS required
+	Submission bool `yaml:"frontline_submission"`
+	// implicit TLS listener (RFC 8314), 0 to disable it
+	ImplicitTLSPort int `yaml:"frontline_implicit_tls_port"`
+}
+
+// frontlineData is what nginx.conf.tmpl is rendered with
+type frontlineData struct {
+	*config.Config
+
+	// the SMTP certificate exists and is valid; the TLS listeners are only
+	// rendered if it is
+	SMTPTLS            bool
+	STARTTLS           bool
+	Submission         bool
+	ImplicitTLSPort    int
+	SMTPCertificate    string
+	SMTPCertificateKey string
+	TLS                *tlsSettings
+}
+
+func loadFrontlineConfig() (*frontlineConfig, error) {
+	c := frontlineConfig{
+		Template:        FRONTLINE_TEMPLATE,
+		STARTTLS:        true,
+		Submission:      true,
+		ImplicitTLSPort: 465,
 	}
+	if err := loadConf(&c); err != nil {
+		return nil, errors.Wrap(err, "could not load frontline config")
+	}
+	return &c, nil
+}
 
-	tmpl := template.Must(
-		template.ParseFiles("/etc/mailway/frontline/nginx.conf.tmpl"))
+func newFrontlineData(c *frontlineConfig) (*frontlineData, error) {
+	tls, err := loadTLSSettings()
+	if err != nil {
+		return nil, err
+	}
 
-	dest, err := os.Create(file)
+	data := &frontlineData{
+		Config:             config.CurrConfig,
+		SMTPCertificate:    smtpCertPath(),
+		SMTPCertificateKey: smtpKeyPath(),
+		TLS:                tls,
+	}
+	if err := checkCert(smtpCertPath(), smtpKeyPath()); err != nil {
+		log.Warnf("inbound SMTP without TLS: %s", err)
+		return data, nil
+	}
+	data.SMTPTLS = true
+	data.STARTTLS = c.STARTTLS
+	data.Submission = c.Submission
+	data.ImplicitTLSPort = c.ImplicitTLSPort
+	return data, nil
+}
+
+type frontlineOptions struct {
+	// replace the config even if it was edited by hand
+	Force bool
+	// show the changes and validate them without installing them
+	DryRun bool
+}
+
+// frontlineFuncs are the helpers available to the frontline templates
+func frontlineFuncs() template.FuncMap {
+	return template.FuncMap{
+		// join ":" .TLS.Ciphers
+		"join": func(sep string, elems []string) string {
+			return strings.Join(elems, sep)
+		},
+		// port "auth"
+		"port": func(name string) (int, error) {
+			c := config.CurrConfig
+			ports := map[string]int{
+				"frontline_smtp":  c.PortFrontlineSMTP,
+				"frontline_smtps": c.PortFrontlineSMTPS,
+				"auth":            c.PortAuth,
+				"mailout":         c.PortMailout,
+				"webhook":         c.PortWebhook,
+				"forwarding":      c.PortForwarding,
+				"maildb":          c.PortMaildb,
+				"responder":       c.PortResponder,
+				"acme_challenge":  ACME_CHALLENGE_PORT,
+			}
+			port, ok := ports[name]
+			if !ok {
+				return 0, errors.Errorf("unknown port %q", name)
+			}
+			return port, nil
+		},
+		// tls "smtp" or tls "http" reports whether the certificate is
+		// there and valid, to only render the listeners that can work
+		"tls": func(name string) (bool, error) {
+			switch name {
+			case "smtp":
+				return checkCert(smtpCertPath(), smtpKeyPath()) == nil, nil
+			case "http":
+				return checkCert(httpCertPath(), httpKeyPath()) == nil, nil
+			}
+			return false, errors.Errorf("unknown certificate %q", name)
+		},
+		// include "http.d" includes the snippets of a drop-in directory
+		"include": func(dir string) string {
+			return "include " + path.Join(FRONTLINE_LOCATION, dir, "*.conf") + ";"
+		},
+	}
+}
+
+func renderFrontlineConf() ([]byte, error) {
+	c, err := loadFrontlineConfig()
+	if err != nil {
+		return nil, err
+	}
+	if c.Template != FRONTLINE_TEMPLATE {
+		log.Infof("using template %s", c.Template)
+	}
+	tmpl, err := template.New(path.Base(c.Template)).Funcs(frontlineFuncs()).ParseFiles(c.Template)
 	if err != nil {
-		return errors.Wrap(err, "could not create conf file")
+		return nil, errors.Wrap(err, "could not parse template")
 	}
-	defer dest.Close()
+	data, err := newFrontlineData(c)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, errors.Wrap(err, "failed to render template")
+	}
+	return out.Bytes(), nil
+}
 
-	err = tmpl.Execute(dest, config.CurrConfig)
+// the checksum of the last generated config, to notice edits by hand
+func frontlineChecksumPath() string {
+	return FRONTLINE_CONF + ".sha256"
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// frontlineConfEdited reports whether the config changed since we generated
+// it. Configs generated before the checksum existed can't be told apart from
+// edited ones and are assumed edited.
+func frontlineConfEdited(live []byte) bool {
+	sum, err := ioutil.ReadFile(frontlineChecksumPath())
 	if err != nil {
-		return errors.Wrap(err, "failed to render template")
+		return true
 	}
+	return strings.TrimSpace(string(sum)) != checksum(live)
+}
 
+func saveFrontlineChecksum(data []byte) {
+	if err := ioutil.WriteFile(frontlineChecksumPath(), []byte(checksum(data)+"\n"), 0644); err != nil {
+		log.Warnf("could not save conf checksum: %s", err)
+	}
+}
+
+func showDiff(oldFile, newFile string) {
+	cmd := exec.Command("diff", "-u", oldFile, newFile)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// diff exits with 1 when the files differ
+	if err := cmd.Run(); err != nil {
+		if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() > 1 {
+			log.Warnf("could not show the changes: %s", err)
+		}
+	}
+}
+
+func validateFrontlineConf(file string) error {
+	out, err := exec.Command(FRONTLINE_NGINX, "-t", "-q", "-c", file).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("invalid frontline config: %s: %s", err,
+			strings.TrimSpace(string(out)))
+	}
 	return nil
 }
 
+// generateFrontlineConf renders the frontline config and installs it if it
+// changed and nginx accepts it; the previous config is kept as nginx.conf.bak
+func generateFrontlineConf(opts frontlineOptions) error {
+	data, err := renderFrontlineConf()
+	if err != nil {
+		return err
+	}
+	next := FRONTLINE_CONF + ".new"
+	if err := ioutil.WriteFile(next, data, 0644); err != nil {
+		return errors.Wrap(err, "could not write conf file")
+	}
+	defer os.Remove(next)
+
+	live, err := ioutil.ReadFile(FRONTLINE_CONF)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not read conf file")
+	}
+	if exists {
+		if bytes.Equal(live, data) {
+			log.Infof("%s is up to date", FRONTLINE_CONF)
+			// adopt configs generated before the checksum existed
+			if frontlineConfEdited(live) && !opts.DryRun {
+				saveFrontlineChecksum(data)
+			}
+			return nil
+		}
+		showDiff(FRONTLINE_CONF, next)
+		if frontlineConfEdited(live) && !opts.Force {
+			err := errors.Errorf("%s was edited by hand or has no checksum; move the changes "+
+				"to a drop-in directory or a frontline_template, or run "+
+				"`mailway reconfigure-frontline --force` to replace it", FRONTLINE_CONF)
+			if !opts.DryRun {
+				return err
+			}
+			log.Warn(err)
+		}
+	} else {
+		log.Infof("creating %s", FRONTLINE_CONF)
+	}
+
+	// the drop-ins are included with a glob, nginx accepts the config
+	// before the directories exist
+	if err := validateFrontlineConf(next); err != nil {
+		return err
+	}
+	if opts.DryRun {
+		log.Infof("dry run; %s left unchanged", FRONTLINE_CONF)
+		return nil
+	}
+
+	for _, dir := range FRONTLINE_DROPINS {
+		dir = path.Join(FRONTLINE_LOCATION, dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrapf(err, "could not create %s", dir)
+		}
+	}
+
+	if exists {
+		if err := ioutil.WriteFile(FRONTLINE_CONF+".bak", live, 0644); err != nil {
+			return errors.Wrap(err, "could not back up conf file")
+		}
+	}
+	if err := os.Rename(next, FRONTLINE_CONF); err != nil {
+		return errors.Wrap(err, "could not replace conf file")
+	}
+	saveFrontlineChecksum(data)
+	log.Infof("%s updated", FRONTLINE_CONF)
+
+	if systemdActiveState("frontline") != "active" {
+		return nil
+	}
+	return reloadFrontline()
+}
+
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Debugf("HTTP %s %s\n", r.Method, r.RequestURI)
@@ -46,42 +299,16 @@ func loggingMiddleware(next http.Handler) http.Handler {
 }
 
 func generateHTTPCert() error {
-	certPath := fmt.Sprintf("/etc/ssl/certs/http-%s.pem", config.CurrConfig.InstanceHostname)
-	privPath := fmt.Sprintf("/etc/ssl/private/http-%s.pem", config.CurrConfig.InstanceHostname)
+	certPath := httpCertPath()
+	privPath := httpKeyPath()
 	if fileExists(certPath) || fileExists(privPath) {
-		log.Warnf("%s or %s already exist; skipping HTTPS key generation.", certPath, privPath)
+		log.Warnf("%s or %s already exist; skipping HTTPS key generation; the supervisor renews it.", certPath, privPath)
 		return nil
 	}
 
-	m := &autocert.Manager{
-		Prompt: autocert.AcceptTOS,
-		Email:  config.CurrConfig.InstanceEmail,
-	}
-
-	h := loggingMiddleware(m.HTTPHandler(nil))
-	go func() {
-		log.Fatal(http.ListenAndServe(":http", h))
-	}()
-
-	log.Infof("asking a certificate for %s; this could take a minute or two", config.CurrConfig.InstanceHostname)
-	cert, err := m.GetCertificate(&tls.ClientHelloInfo{
-		ServerName: config.CurrConfig.InstanceHostname,
-	})
-	if err != nil {
+	if err := issueHTTPCert(context.Background()); err != nil {
 		return errors.Wrap(err, "could not generate certificate")
-	} else {
-		log.Info("OK")
 	}
-
-	// certificate
-	if err := saveCert(certPath, cert.Certificate); err != nil {
-		return errors.Wrap(err, "could not save certificate")
-	}
-
-	// private key
-	if err := savePrivateKey(privPath, cert.PrivateKey); err != nil {
-		return errors.Wrap(err, "could not save private key")
-	}
-
+	log.Info("OK")
 	return nil
 }
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	HEALTH_CHECK_INTERVAL = 1 * time.Minute
+	HEALTH_LOCATION       = path.Join(config.RUNTIME_LOCATION, "health")
+	// number of checks kept per service
+	HEALTH_HISTORY_SIZE = 30
+	// consecutive failed probes before an active service is restarted
+	HEALTH_FAILURES_BEFORE_RESTART = 3
+	// minimum time between two restarts or two alerts of the same service
+	HEALTH_COOLDOWN = 15 * time.Minute
+	// changes between healthy and unhealthy in the history for a service to
+	// be flapping
+	HEALTH_FLAP_THRESHOLD = 4
+
+	// how to check that the service is responding, by systemd unit
+	SERVICE_PROBES = map[string]func() serviceProbe{
+		"mailout": func() serviceProbe {
+			return smtpProbe(config.CurrConfig.PortMailout)
+		},
+		"forwarding": func() serviceProbe {
+			return smtpProbe(config.CurrConfig.PortForwarding)
+		},
+		"webhooks": func() serviceProbe {
+			return smtpProbe(config.CurrConfig.PortWebhook)
+		},
+		"frontline": func() serviceProbe {
+			return smtpProbe(config.CurrConfig.PortFrontlineSMTP)
+		},
+		"maildb": func() serviceProbe {
+			return httpProbe(config.CurrConfig.PortMaildb)
+		},
+		"auth": func() serviceProbe {
+			return httpProbe(config.CurrConfig.PortAuth)
+		},
+	}
+
+	serviceHealth = newHealthMonitor()
+)
+
+type serviceProbe func() error
+
+func smtpProbe(port int) serviceProbe {
+	return func() error {
+		conn, err := net.DialTimeout("tcp", localAddr(port), VIA_DIAL_TIMEOUT)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(VIA_DIAL_TIMEOUT))
+		text := textproto.NewConn(conn)
+		if _, _, err := text.ReadResponse(220); err != nil {
+			return errors.Wrap(err, "no SMTP greeting")
+		}
+		text.PrintfLine("QUIT")
+		return nil
+	}
+}
+
+func httpProbe(port int) serviceProbe {
+	return func() error {
+		res, err := httpClient.Get(fmt.Sprintf("http://%s/", localAddr(port)))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		// any answer that isn't a server error means the service is up
+		if res.StatusCode >= 500 {
+			return errors.Errorf("HTTP %d", res.StatusCode)
+		}
+		return nil
+	}
+}
+
+type healthCheck struct {
+	At      time.Time `json:"at"`
+	Active  string    `json:"active"`
+	Healthy bool      `json:"healthy"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type serviceState struct {
+	Service     string        `json:"service"`
+	History     []healthCheck `json:"history"`
+	Failures    int           `json:"consecutive_failures"`
+	LastRestart time.Time     `json:"last_restart,omitempty"`
+	LastAlert   time.Time     `json:"last_alert,omitempty"`
+}
+
+func (s *serviceState) last() *healthCheck {
+	if len(s.History) == 0 {
+		return nil
+	}
+	return &s.History[len(s.History)-1]
+}
+
+// flaps returns the number of changes between healthy and unhealthy in the
+// history
+func (s *serviceState) flaps() int {
+	flaps := 0
+	for i := 1; i < len(s.History); i++ {
+		if s.History[i].Healthy != s.History[i-1].Healthy {
+			flaps++
+		}
+	}
+	return flaps
+}
+
+type healthMonitor struct {
+	sync.Mutex
+	services map[string]*serviceState
+}
+
+func newHealthMonitor() *healthMonitor {
+	return &healthMonitor{
+		services: make(map[string]*serviceState),
+	}
+}
+
+// snapshot returns a copy of the state of the services
+func (m *healthMonitor) snapshot() []serviceState {
+	m.Lock()
+	defer m.Unlock()
+	states := make([]serviceState, 0)
+	for _, service := range SERVICES {
+		if state, ok := m.services[service]; ok {
+			states = append(states, *state)
+		}
+	}
+	return states
+}
+
+func systemdActiveState(unit string) string {
+	out, err := exec.Command("systemctl", "show", "-p", "ActiveState", "--value", unit).Output()
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// check probes the service and records the result
+func (m *healthMonitor) check(service string, newProbe func() serviceProbe) {
+	c := healthCheck{
+		At:     time.Now(),
+		Active: systemdActiveState(service),
+	}
+	if err := newProbe()(); err != nil {
+		c.Error = err.Error()
+	} else {
+		c.Healthy = c.Active == "active" || c.Active == "unknown"
+		if !c.Healthy {
+			c.Error = "systemd unit is " + c.Active
+		}
+	}
+
+	m.Lock()
+	state, ok := m.services[service]
+	if !ok {
+		state = &serviceState{Service: service}
+		m.services[service] = state
+	}
+	prev := state.last()
+	wasHealthy := prev == nil || prev.Healthy
+	state.History = append(state.History, c)
+	if len(state.History) > HEALTH_HISTORY_SIZE {
+		state.History = state.History[len(state.History)-HEALTH_HISTORY_SIZE:]
+	}
+	if c.Healthy {
+		state.Failures = 0
+	} else {
+		state.Failures++
+	}
+	flaps := state.flaps()
+	restart := !c.Healthy && c.Active == "active" &&
+		state.Failures >= HEALTH_FAILURES_BEFORE_RESTART &&
+		time.Since(state.LastRestart) > HEALTH_COOLDOWN
+	if restart {
+		state.LastRestart = c.At
+	}
+	alert := flaps >= HEALTH_FLAP_THRESHOLD && time.Since(state.LastAlert) > HEALTH_COOLDOWN
+	if alert {
+		state.LastAlert = c.At
+	}
+	m.Unlock()
+
+	switch {
+	case wasHealthy && !c.Healthy:
+		log.Warnf("service %s is unhealthy: %s", service, c.Error)
+	case !wasHealthy && c.Healthy:
+		log.Infof("service %s is healthy again", service)
+	}
+
+	if restart {
+		// systemd thinks the service is fine but it doesn't answer
+		log.Errorf("service %s is active but failed %d probes; restarting",
+			service, HEALTH_FAILURES_BEFORE_RESTART)
+		if err := exec.Command("systemctl", "restart", service).Run(); err != nil {
+			log.Errorf("failed to restart service %s: %s", service, err)
+		}
+	}
+	if alert {
+		// mailout might be the service that is flapping; the watchdog
+		// doesn't wait for it
+		go sendHealthAlert(service, flaps, c)
+	}
+}
+
+// save writes the state of the services for mailway status
+func (m *healthMonitor) save() error {
+	if err := os.MkdirAll(HEALTH_LOCATION, 0755); err != nil {
+		return errors.Wrapf(err, "could not create %s", HEALTH_LOCATION)
+	}
+	data, err := json.Marshal(m.snapshot())
+	if err != nil {
+		return errors.Wrap(err, "could not encode health")
+	}
+	dest := path.Join(HEALTH_LOCATION, "services.json")
+	if err := ioutil.WriteFile(dest+".tmp", data, 0644); err != nil {
+		return errors.Wrap(err, "could not write health")
+	}
+	return errors.Wrap(os.Rename(dest+".tmp", dest), "could not write health")
+}
+
+// sendHealthAlert warns the instance's owner that a service keeps going up
+// and down
+func sendHealthAlert(service string, flaps int, c healthCheck) {
+	log.Errorf("ALERT: service %s is flapping; %d state changes in the last %d checks",
+		service, flaps, HEALTH_HISTORY_SIZE)
+
+	to := config.CurrConfig.InstanceEmail
+	if to == "" {
+		return
+	}
+	hostname := config.CurrConfig.InstanceHostname
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: Mailway supervisor <MAILER-DAEMON@%s>\r\n", hostname)
+	fmt.Fprintf(&body, "To: <%s>\r\n", to)
+	fmt.Fprintf(&body, "Subject: [%s] service %s is flapping\r\n", hostname, service)
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(&body, "\r\n")
+	fmt.Fprintf(&body, "Service %s changed state %d times in the last %d checks.\r\n",
+		service, flaps, HEALTH_HISTORY_SIZE)
+	if c.Error != "" {
+		fmt.Fprintf(&body, "Last error: %s\r\n", c.Error)
+	}
+
+	if err := sendMailout("", []string{to}, []byte(body.String())); err != nil {
+		log.Errorf("could not send alert: %s", err)
+	}
+}
+
+// superviseServices probes the services until ctx is done
+func superviseServices(ctx context.Context) {
+	log.Info("service health watchdog running")
+	ticker := time.NewTicker(HEALTH_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		for _, service := range SERVICES {
+			newProbe, ok := SERVICE_PROBES[service]
+			if !ok {
+				continue
+			}
+			serviceHealth.check(service, newProbe)
+		}
+		if err := serviceHealth.save(); err != nil {
+			log.Warn(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// healthStatus prints the last known health of the services
+func healthStatus() error {
+	data, err := ioutil.ReadFile(path.Join(HEALTH_LOCATION, "services.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not read health")
+	}
+	var states []serviceState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return errors.Wrap(err, "could not parse health")
+	}
+
+	fmt.Printf("\nHealth:\n")
+	for _, state := range states {
+		c := state.last()
+		if c == nil {
+			continue
+		}
+		status := "healthy"
+		if !c.Healthy {
+			status = "unhealthy: " + c.Error
+		}
+		if flaps := state.flaps(); flaps >= HEALTH_FLAP_THRESHOLD {
+			status += fmt.Sprintf(" (flapping, %d changes)", flaps)
+		}
+		fmt.Printf("  %-12s %s (checked %s ago)\n", state.Service, status,
+			time.Since(c.At).Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+)
+
+var (
+	// Mw-Int-Id headers allowed on top of the max_attempts of the via, for
+	// the passes through the services before the email was buffered
+	LOOP_HOPS_MARGIN = 10
+	// maximum number of Received headers, which also counts the hops before
+	// the email reached us
+	LOOP_MAX_RECEIVED = 50
+)
+
+// loopError is returned when an email went through the services too many
+// times; it is quarantined instead of being sent back again
+type loopError struct {
+	Reason string
+}
+
+func (e *loopError) Error() string {
+	return fmt.Sprintf("mail loop detected: %s", e.Reason)
+}
+
+// loopMaxHops returns how many Mw-Int-Id headers an email to the via can
+// carry. Every retry adds one, so the limit stays above max_attempts and an
+// email that keeps failing is dead-lettered rather than taken for a loop.
+func (c *retryConfig) loopMaxHops(via string) int {
+	if c.LoopMaxHops > 0 {
+		return c.LoopMaxHops
+	}
+	return c.policyFor(via).MaxAttempts + LOOP_HOPS_MARGIN
+}
+
+// detectLoop looks for signs that the email is circulating between the
+// services and the retrier
+func detectLoop(header mail.Header, maxHops int) error {
+	ids := mailIds(header)
+	if len(ids) > maxHops {
+		return &loopError{fmt.Sprintf("%d Mw-Int-Id headers, limit is %d", len(ids), maxHops)}
+	}
+	if received := len(header["Received"]); received > LOOP_MAX_RECEIVED {
+		return &loopError{fmt.Sprintf("%d Received headers, limit is %d", received, LOOP_MAX_RECEIVED)}
+	}
+
+	// the services generate a new id each time the email goes through them,
+	// seeing one twice means it was injected again as is
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			return &loopError{fmt.Sprintf("Mw-Int-Id %s seen twice", id)}
+		}
+		seen[id] = true
+	}
+	return nil
+}
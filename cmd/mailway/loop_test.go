@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"testing"
+)
+
+func headerWith(ids int, received int) mail.Header {
+	header := mail.Header{}
+	for i := 0; i < ids; i++ {
+		header["Mw-Int-Id"] = append(header["Mw-Int-Id"], fmt.Sprintf("id-%d", i))
+	}
+	for i := 0; i < received; i++ {
+		header["Received"] = append(header["Received"], fmt.Sprintf("from hop-%d", i))
+	}
+	return header
+}
+
+func TestDetectLoop(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  mail.Header
+		maxHops int
+		loop    bool
+	}{
+		{"no header", mail.Header{}, 30, false},
+		{"one id", headerWith(1, 3), 30, false},
+		{"at the limit", headerWith(30, 0), 30, false},
+		{"above the limit", headerWith(31, 0), 30, true},
+		{"received at the limit", headerWith(1, LOOP_MAX_RECEIVED), 30, false},
+		{"received above the limit", headerWith(1, LOOP_MAX_RECEIVED+1), 30, true},
+		{"same id twice", mail.Header{"Mw-Int-Id": {"a", "b", "a"}}, 30, true},
+	}
+	for _, test := range tests {
+		err := detectLoop(test.header, test.maxHops)
+		if _, ok := err.(*loopError); ok != test.loop {
+			t.Errorf("%s: got %v, want loop %v", test.name, err, test.loop)
+		}
+	}
+}
+
+func TestLoopMaxHops(t *testing.T) {
+	c := &retryConfig{
+		Policy: retryPolicy{MaxAttempts: 20},
+		Via:    map[string]retryPolicy{"responder": {MaxAttempts: 5}},
+	}
+
+	tests := []struct {
+		via         string
+		loopMaxHops int
+		want        int
+	}{
+		{"forwarding", 0, 20 + LOOP_HOPS_MARGIN},
+		{"responder", 0, 5 + LOOP_HOPS_MARGIN},
+		{"forwarding", 40, 40},
+	}
+	for _, test := range tests {
+		c.LoopMaxHops = test.loopMaxHops
+		if got := c.loopMaxHops(test.via); got != test.want {
+			t.Errorf("%s with retry_loop_max_hops %d: got %d, want %d",
+				test.via, test.loopMaxHops, got, test.want)
+		}
+	}
+
+	// every attempt up to max_attempts carries one more Mw-Int-Id
+	c.LoopMaxHops = 0
+	for attempt := 1; attempt <= c.Policy.MaxAttempts; attempt++ {
+		if err := detectLoop(headerWith(attempt, 0), c.loopMaxHops("forwarding")); err != nil {
+			t.Errorf("attempt %d: %s", attempt, err)
+		}
+	}
+
+	c.LoopMaxHops = 20
+	if err := c.validateLoopMaxHops(c.Policy); err == nil {
+		t.Errorf("retry_loop_max_hops equal to max_attempts should be rejected")
+	}
+	c.LoopMaxHops = 21
+	if err := c.validateLoopMaxHops(c.Policy); err != nil {
+		t.Errorf("retry_loop_max_hops above max_attempts: %s", err)
+	}
+}
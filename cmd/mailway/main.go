@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -95,30 +96,14 @@ func logs() {
 	}
 }
 
-func setupSecureSmtp() error {
-	log.Info("Install certbot")
-	cmd := exec.Command("apt-get", "install", "-y", "certbot")
-	log.Debug(cmd)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		return errors.Wrap(err, "failed to install certbot")
+func setupSecureSmtp(opts frontlineOptions) error {
+	if err := issueSMTPCert(context.Background()); err != nil {
+		return errors.Wrap(err, "failed to obtain SMTP certificate")
 	}
-
-	log.Info("Run certbot")
-	cmd = exec.Command("certbot", "certonly", "--manual",
-		"--domain="+config.CurrConfig.InstanceHostname, "--email="+config.CurrConfig.InstanceEmail,
-		"--cert-name=smtp-"+config.CurrConfig.InstanceHostname, "--preferred-challenges=dns")
-	log.Debug(cmd)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	err = cmd.Run()
-	if err != nil {
-		return errors.Wrap(err, "failed to install certbot")
+	// the TLS listeners are only rendered once the certificate exists
+	if err := generateFrontlineConf(opts); err != nil {
+		return errors.Wrap(err, "failed to enable TLS in frontline")
 	}
-
 	return nil
 }
 
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	DEFAULT_METRICS_PORT = 9095
+
+	metrics = newSupervisorMetrics()
+)
+
+// supervisor.yml in conf.d
+type supervisorConfig struct {
+	// local port of the Prometheus endpoint, 0 to disable it
+	MetricsPort int `yaml:"supervisor_metrics_port"`
+}
+
+func loadSupervisorConfig() (*supervisorConfig, error) {
+	c := supervisorConfig{MetricsPort: DEFAULT_METRICS_PORT}
+	if err := loadConf(&c); err != nil {
+		return nil, errors.Wrap(err, "could not load supervisor config")
+	}
+	return &c, nil
+}
+
+// supervisorMetrics holds the counters updated by the retrier; everything
+// else is read from disk when scraped
+type supervisorMetrics struct {
+	sync.Mutex
+	// by via
+	attempts     map[string]uint64
+	successes    map[string]uint64
+	failures     map[string]uint64
+	deadLettered map[string]uint64
+	quarantined  map[string]uint64
+}
+
+func newSupervisorMetrics() *supervisorMetrics {
+	return &supervisorMetrics{
+		attempts:     make(map[string]uint64),
+		successes:    make(map[string]uint64),
+		failures:     make(map[string]uint64),
+		deadLettered: make(map[string]uint64),
+		quarantined:  make(map[string]uint64),
+	}
+}
+
+func (m *supervisorMetrics) recordRetry(via string, outcome retryOutcome) {
+	m.Lock()
+	defer m.Unlock()
+	m.attempts[via]++
+	switch outcome {
+	case retrySent:
+		m.successes[via]++
+	case retryDeadLettered:
+		m.deadLettered[via]++
+	case retryQuarantined:
+		m.quarantined[via]++
+	default:
+		m.failures[via]++
+	}
+}
+
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+// writeMetric writes a metric in the Prometheus text format
+func writeMetric(w io.Writer, name, typ, help string, samples ...metricSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	for _, sample := range samples {
+		if sample.labels != "" {
+			fmt.Fprintf(w, "%s{%s} %g\n", name, sample.labels, sample.value)
+		} else {
+			fmt.Fprintf(w, "%s %g\n", name, sample.value)
+		}
+	}
+}
+
+func label(name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return fmt.Sprintf(`%s="%s"`, name, value)
+}
+
+func counterSamples(counts map[string]uint64) []metricSample {
+	samples := make([]metricSample, 0)
+	for via, count := range counts {
+		samples = append(samples, metricSample{label("via", via), float64(count)})
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].labels < samples[j].labels })
+	return samples
+}
+
+func writeRetryMetrics(w io.Writer) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	writeMetric(w, "mailway_retry_attempts_total", "counter",
+		"Emails the retrier tried to send back, by via", counterSamples(metrics.attempts)...)
+	writeMetric(w, "mailway_retry_successes_total", "counter",
+		"Emails the retrier sent back, by via", counterSamples(metrics.successes)...)
+	writeMetric(w, "mailway_retry_failures_total", "counter",
+		"Emails the retrier failed to send back and kept queued, by via",
+		counterSamples(metrics.failures)...)
+	writeMetric(w, "mailway_retry_dead_lettered_total", "counter",
+		"Emails the retrier moved to the dead letters, by via", counterSamples(metrics.deadLettered)...)
+	writeMetric(w, "mailway_retry_quarantined_total", "counter",
+		"Emails the retrier moved to quarantine, by via", counterSamples(metrics.quarantined)...)
+}
+
+func writeQueueMetrics(w io.Writer) error {
+	files, err := ioutil.ReadDir(config.RUNTIME_LOCATION)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", config.RUNTIME_LOCATION)
+	}
+
+	depth := make(map[string]uint64)
+	var oldest time.Time
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		via := ""
+		if f, err := os.Open(path.Join(config.RUNTIME_LOCATION, file.Name())); err == nil {
+			if msg, err := mail.ReadMessage(f); err == nil {
+				via = msg.Header.Get("Mw-Int-Via")
+			}
+			f.Close()
+		}
+		depth[via]++
+
+		queuedAt := file.ModTime()
+		if state, _ := readRetryState(file.Name()); state != nil {
+			queuedAt = state.FirstSeen
+		}
+		if oldest.IsZero() || queuedAt.Before(oldest) {
+			oldest = queuedAt
+		}
+	}
+	writeMetric(w, "mailway_queue_depth", "gauge",
+		"Emails waiting to be retried, by via", counterSamples(depth)...)
+
+	oldestAge := 0.0
+	if !oldest.IsZero() {
+		oldestAge = time.Since(oldest).Seconds()
+	}
+	writeMetric(w, "mailway_queue_oldest_age_seconds", "gauge",
+		"Age of the oldest email waiting to be retried", metricSample{value: oldestAge})
+
+	for _, dir := range []struct {
+		name, path, help string
+	}{
+		{"mailway_queue_held", QUEUE_HOLD_LOCATION, "Emails held in the queue"},
+		{"mailway_dead_letters", DEAD_LETTER_LOCATION, "Emails the retrier gave up on"},
+		{"mailway_quarantined", QUARANTINE_LOCATION, "Emails the retrier can't process"},
+	} {
+		count, err := countFiles(dir.path)
+		if err != nil {
+			return err
+		}
+		writeMetric(w, dir.name, "gauge", dir.help, metricSample{value: float64(count)})
+	}
+	return nil
+}
+
+func writeExpiryMetrics(w io.Writer) {
+	if token := config.CurrConfig.ServerJWT; token != "" && !config.CurrConfig.IsInstanceLocal() {
+		if jwt, err := parseJWT(token); err == nil {
+			claims := jwt.Claims.(*JWTClaims)
+			writeMetric(w, "mailway_server_jwt_expiry_seconds", "gauge",
+				"Time until the server JWT expires",
+				metricSample{value: time.Until(time.Unix(claims.ExpiresAt, 0)).Seconds()})
+		} else {
+			log.Debugf("metrics: %s", err)
+		}
+	}
+
+	certs := make([]metricSample, 0)
+	for _, cert := range []struct{ name, path string }{
+		{"http", httpCertPath()},
+		{"smtp", smtpCertPath()},
+	} {
+		c, err := readCertificate(cert.path)
+		if err != nil {
+			log.Debugf("metrics: %s", err)
+			continue
+		}
+		certs = append(certs, metricSample{
+			labels: label("name", cert.name) + "," + label("path", cert.path),
+			value:  time.Until(c.NotAfter).Seconds(),
+		})
+	}
+	writeMetric(w, "mailway_certificate_expiry_seconds", "gauge",
+		"Time until the certificate expires", certs...)
+
+	// the DKIM key is a bare public key that doesn't expire; its age tells
+	// when it was last rotated
+	if info, err := os.Stat(config.CurrConfig.OutDKIMPath); err == nil {
+		writeMetric(w, "mailway_dkim_key_age_seconds", "gauge",
+			"Time since the DKIM key was generated",
+			metricSample{value: time.Since(info.ModTime()).Seconds()})
+	}
+}
+
+func writeHealthMetrics(w io.Writer) {
+	up := make([]metricSample, 0)
+	flaps := make([]metricSample, 0)
+	for _, state := range serviceHealth.snapshot() {
+		c := state.last()
+		if c == nil {
+			continue
+		}
+		value := 0.0
+		if c.Healthy {
+			value = 1
+		}
+		up = append(up, metricSample{label("service", state.Service), value})
+		flaps = append(flaps, metricSample{label("service", state.Service),
+			float64(state.flaps())})
+	}
+	writeMetric(w, "mailway_service_up", "gauge",
+		"Whether the service answered the last probe", up...)
+	writeMetric(w, "mailway_service_flaps", "gauge",
+		"Changes between healthy and unhealthy in the recent checks", flaps...)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var out bytes.Buffer
+	writeRetryMetrics(&out)
+	if err := writeQueueMetrics(&out); err != nil {
+		log.Errorf("could not collect queue metrics: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeExpiryMetrics(&out)
+	writeHealthMetrics(&out)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := w.Write(out.Bytes()); err != nil {
+		log.Debugf("could not write metrics: %s", err)
+	}
+}
+
+// serveMetrics exposes /metrics on localhost until ctx is done
+func serveMetrics(ctx context.Context, port int) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	server := &http.Server{
+		Addr:    localAddr(port),
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Infof("metrics available on http://%s/metrics", server.Addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return errors.Wrap(err, "could not serve metrics")
+	}
+	return nil
+}
@@ -48,12 +48,15 @@ func saveCert(name string, cert [][]byte) error {
 	return nil
 }
 
-func savePrivateKey(name string, key crypto.PrivateKey) error {
+func savePrivateKey(name string, key crypto.PrivateKey, perm os.FileMode) error {
 	log.Debugf("write private key %s", name)
-	f, err := os.Create(name)
+	// created with its final mode so that it's never readable by others
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		return errors.Wrap(err, "could not create file")
 	}
+	defer f.Close()
+
 	err = pem.Encode(f, &pem.Block{
 		Type:  "RSA PRIVATE KEY",
 		Bytes: x509.MarshalPKCS1PrivateKey(key.(*rsa.PrivateKey)),
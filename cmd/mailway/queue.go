@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/manifoldco/promptui"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	QUEUE_HOLD_LOCATION = path.Join(config.RUNTIME_LOCATION, "hold")
+
+	errQueueFileLocked = errors.New("file is being processed")
+)
+
+// email buffered in the runtime directory waiting to be retried
+type queuedEmail struct {
+	Id        string     `json:"id"`
+	Path      string     `json:"path"`
+	From      string     `json:"from"`
+	To        string     `json:"to"`
+	Via       string     `json:"via"`
+	Held      bool       `json:"held"`
+	Retries   int        `json:"retries"`
+	QueuedAt  time.Time  `json:"queued_at"`
+	Age       string     `json:"age"`
+	NextRetry *time.Time `json:"next_retry,omitempty"`
+	// last SMTP response or error
+	LastResponse string `json:"last_response,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+func queuePath(id string) (string, error) {
+	if id == "" || filepath.Base(id) != id {
+		return "", errors.Errorf("invalid queue id: %s", id)
+	}
+	abspath := path.Join(config.RUNTIME_LOCATION, id)
+	if fileExists(abspath) {
+		return abspath, nil
+	}
+	holdpath := path.Join(QUEUE_HOLD_LOCATION, id)
+	if fileExists(holdpath) {
+		return holdpath, nil
+	}
+	return "", errors.Errorf("%s not found in queue", id)
+}
+
+// lockQueueFile takes an exclusive lock on a queued file so that the retrier
+// and the CLI never process the same email at the same time
+func lockQueueFile(abspath string) (func(), error) {
+	f, err := os.Open(abspath)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open file")
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errQueueFileLocked
+		}
+		return nil, errors.Wrap(err, "could not lock file")
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func readQueuedEmail(retryConf *retryConfig, orphans map[string]*retryState,
+	dir string, file os.FileInfo) (queuedEmail, error) {
+	abspath := path.Join(dir, file.Name())
+	email := queuedEmail{
+		Id:       file.Name(),
+		Path:     abspath,
+		Held:     dir == QUEUE_HOLD_LOCATION,
+		QueuedAt: file.ModTime(),
+		Age:      time.Since(file.ModTime()).Round(time.Second).String(),
+	}
+
+	data, err := ioutil.ReadFile(abspath)
+	if err != nil {
+		return email, errors.Wrap(err, "could not read file")
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return email, errors.Wrap(err, "could not read message")
+	}
+
+	email.From = msg.Header.Get("Mw-Int-Mail-From")
+	email.To = strings.Join(emailRecipients(msg.Header), ", ")
+	email.Via = msg.Header.Get("Mw-Int-Via")
+
+	state, err := peekRetryState(email.Id, msg.Header, file.ModTime(), orphans)
+	if err != nil {
+		return email, err
+	}
+	email.Retries = len(state.Attempts)
+	email.QueuedAt = state.FirstSeen
+	email.Age = time.Since(state.FirstSeen).Round(time.Second).String()
+	email.LastResponse = state.lastResponse()
+
+	policy := retryConf.policyFor(email.Via)
+	nextRetry, err := getNextRetry(policy, state)
+	if err != nil {
+		email.Error = err.Error()
+	} else {
+		email.NextRetry = &nextRetry
+	}
+	return email, nil
+}
+
+func listQueueDir(dir string) ([]queuedEmail, error) {
+	retryConf, err := loadRetryConfig()
+	if err != nil {
+		return nil, err
+	}
+	orphans, err := peekOrphanRetryStates()
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", dir)
+	}
+
+	emails := make([]queuedEmail, 0)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		email, err := readQueuedEmail(retryConf, orphans, dir, file)
+		if err != nil {
+			email.Error = err.Error()
+		}
+		emails = append(emails, email)
+	}
+	return emails, nil
+}
+
+func listQueue() ([]queuedEmail, error) {
+	emails, err := listQueueDir(config.RUNTIME_LOCATION)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(QUEUE_HOLD_LOCATION); err == nil {
+		held, err := listQueueDir(QUEUE_HOLD_LOCATION)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, held...)
+	}
+
+	sort.Slice(emails, func(i, j int) bool {
+		return emails[i].QueuedAt.Before(emails[j].QueuedAt)
+	})
+	return emails, nil
+}
+
+func printJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not encode JSON")
+	}
+	fmt.Printf("%s\n", out)
+	return nil
+}
+
+func queueList(asJSON bool) error {
+	emails, err := listQueue()
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(emails)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFROM\tTO\tVIA\tRETRIES\tAGE\tNEXT RETRY")
+	for _, email := range emails {
+		next := email.Error
+		if email.Held {
+			next = "held"
+		} else if email.NextRetry != nil {
+			next = email.NextRetry.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", email.Id, email.From,
+			email.To, email.Via, email.Retries, email.Age, next)
+	}
+	return w.Flush()
+}
+
+func queueShow(id string, asJSON bool) error {
+	abspath, err := queuePath(id)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(abspath)
+	if err != nil {
+		return errors.Wrap(err, "could not read file")
+	}
+
+	if !asJSON {
+		fmt.Printf("%s", data)
+		return nil
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "could not read message")
+	}
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return errors.Wrap(err, "could not read body")
+	}
+	return printJSON(struct {
+		Id      string              `json:"id"`
+		Headers map[string][]string `json:"headers"`
+		Body    string              `json:"body"`
+	}{id, msg.Header, string(body)})
+}
+
+// queueIds returns the given ids or, if none, every email in dir
+func queueIds(ids []string, dir string) ([]string, error) {
+	if len(ids) > 0 {
+		return ids, nil
+	}
+	emails, err := listQueueDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, email := range emails {
+		ids = append(ids, email.Id)
+	}
+	return ids, nil
+}
+
+func queueFlush(ids []string) error {
+	defer smtpSessions.closeIdle(0)
+
+	ids, err := queueIds(ids, config.RUNTIME_LOCATION)
+	if err != nil {
+		return err
+	}
+	retryConf, err := loadRetryConfig()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, id := range ids {
+		abspath := path.Join(config.RUNTIME_LOCATION, id)
+		if _, err := queuePath(id); err != nil || !fileExists(abspath) {
+			log.Errorf("%s is not in the queue or is held", id)
+			failed++
+			continue
+		}
+		log.Infof("%s flushing now", abspath)
+		outcome, err := retryEmail(abspath, retryConf)
+		if err != nil {
+			log.Errorf("failed to flush %s: %s", id, err)
+			failed++
+		} else if outcome != retrySent {
+			log.Errorf("%s was %s", id, outcome)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("%d email(s) failed to flush", failed)
+	}
+	return nil
+}
+
+// moveQueuedEmail moves a queued email between the queue and the hold
+// directory while holding its lock
+func moveQueuedEmail(id, from, to string) error {
+	if _, err := queuePath(id); err != nil {
+		return err
+	}
+	src := path.Join(from, id)
+	if !fileExists(src) {
+		return errors.Errorf("%s not found in %s", id, from)
+	}
+
+	unlock, err := lockQueueFile(src)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return errors.Wrapf(err, "could not create %s", to)
+	}
+	if err := os.Rename(src, path.Join(to, id)); err != nil {
+		return errors.Wrap(err, "could not move file")
+	}
+	return nil
+}
+
+func queueHold(ids []string) error {
+	for _, id := range ids {
+		if err := moveQueuedEmail(id, config.RUNTIME_LOCATION, QUEUE_HOLD_LOCATION); err != nil {
+			return errors.Wrapf(err, "could not hold %s", id)
+		}
+		log.Infof("%s held", id)
+	}
+	return nil
+}
+
+func queueRelease(ids []string) error {
+	ids, err := queueIds(ids, QUEUE_HOLD_LOCATION)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := moveQueuedEmail(id, QUEUE_HOLD_LOCATION, config.RUNTIME_LOCATION); err != nil {
+			return errors.Wrapf(err, "could not release %s", id)
+		}
+		log.Infof("%s released", id)
+	}
+	return nil
+}
+
+func queueDelete(ids []string, skipConfirm bool) error {
+	if !skipConfirm {
+		prompt := promptui.Prompt{
+			Label:     fmt.Sprintf("Delete %d email(s) from the queue", len(ids)),
+			IsConfirm: true,
+		}
+		if _, err := prompt.Run(); err != nil {
+			return errors.New("deletion aborted")
+		}
+	}
+
+	for _, id := range ids {
+		abspath, err := queuePath(id)
+		if err != nil {
+			return err
+		}
+		unlock, err := lockQueueFile(abspath)
+		if err != nil {
+			return errors.Wrapf(err, "could not delete %s", id)
+		}
+		err = os.Remove(abspath)
+		unlock()
+		if err != nil {
+			return errors.Wrap(err, "could not delete file")
+		}
+		if err := deleteRetryState(id); err != nil {
+			log.Warn(err)
+		}
+		log.Infof("%s deleted", id)
+	}
+	return nil
+}
+
+// countFiles returns the number of emails in dir, ignoring sub directories
+// and reason files
+func countFiles(dir string) (int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to read %s", dir)
+	}
+	count := 0
+	for _, file := range files {
+		if file.IsDir() || strings.HasSuffix(file.Name(), PARKED_REASON_EXT) {
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
+
+// queueStatus prints how many emails are in the queue and out of it
+func queueStatus() error {
+	counts := make([]int, 0)
+	for _, dir := range []string{config.RUNTIME_LOCATION, QUEUE_HOLD_LOCATION,
+		DEAD_LETTER_LOCATION, QUARANTINE_LOCATION} {
+		count, err := countFiles(dir)
+		if err != nil {
+			return err
+		}
+		counts = append(counts, count)
+	}
+
+	fmt.Printf("\nQueue: %d queued, %d held, %d dead, %d quarantined\n",
+		counts[0], counts[1], counts[2], counts[3])
+	if counts[3] > 0 {
+		fmt.Printf("Run `mailway queue quarantine list` to see why emails were quarantined\n")
+	}
+	return nil
+}
@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/mail"
-	"net/smtp"
+	"net/textproto"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/mailway-app/config"
 
@@ -14,54 +18,371 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func recoverEmail(file string) error {
+// temporaryError is returned when the email could not be delivered for now,
+// either because of a 4xx reply or a network failure; it stays in the queue
+type temporaryError struct {
+	Err error
+}
+
+func (e *temporaryError) Error() string {
+	return fmt.Sprintf("temporary failure: %s", e.Err)
+}
+
+// badEmailError is returned when the queued file can't be read or parsed; it
+// is quarantined since retrying won't help
+type badEmailError struct {
+	Err error
+}
+
+func (e *badEmailError) Error() string {
+	return e.Err.Error()
+}
+
+// serviceDownError is returned when the local service refused the connection.
+// It says nothing about the email so it doesn't count as an attempt.
+type serviceDownError struct {
+	Err error
+}
+
+func (e *serviceDownError) Error() string {
+	return fmt.Sprintf("local service down: %s", e.Err)
+}
+
+// sendError classifies the error returned by a via handler: permanent
+// rejections (5xx), local service down or temporary failures
+func sendError(err error) error {
+	switch e := err.(type) {
+	case *permanentError, *temporaryError, *serviceDownError:
+		return err
+	case *textproto.Error:
+		if e.Code >= 500 {
+			return &permanentError{Code: e.Code, Msg: e.Msg}
+		}
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return &serviceDownError{err}
+	}
+	return &temporaryError{err}
+}
+
+// isQueueFile reports whether the file is an email in the retry queue, as
+// opposed to one recovered from elsewhere
+func isQueueFile(file string) bool {
+	abspath, err := filepath.Abs(file)
+	return err == nil && filepath.Dir(abspath) == config.RUNTIME_LOCATION
+}
+
+// recordRetryAttempt adds the outcome of an attempt to the retry history of
+// the email
+func recordRetryAttempt(file string, header mail.Header, sendErr error) {
+	// emails recovered from elsewhere have no retry history
+	if !isQueueFile(file) {
+		return
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		log.Warnf("could not record attempt: %s", err)
+		return
+	}
+	state, err := getRetryState(filepath.Base(file), header, info.ModTime(), nil)
+	if err != nil {
+		log.Warnf("could not record attempt: %s", err)
+		return
+	}
+	state.recordAttempt(sendErr)
+	if err := state.save(); err != nil {
+		log.Warnf("could not record attempt: %s", err)
+	}
+}
+
+// emailRecipients returns the recipients of the email; Mw-Int-Rcpt-To can be
+// repeated and hold a comma separated list
+func emailRecipients(header mail.Header) []string {
+	rcpts := make([]string, 0)
+	for _, value := range header["Mw-Int-Rcpt-To"] {
+		for _, rcpt := range strings.Split(value, ",") {
+			rcpt = strings.Trim(strings.TrimSpace(rcpt), "<>")
+			if rcpt != "" {
+				rcpts = append(rcpts, rcpt)
+			}
+		}
+	}
+	return rcpts
+}
+
+// setRecipients replaces the Mw-Int-Rcpt-To headers of the raw email with a
+// single one listing rcpts
+func setRecipients(data []byte, rcpts []string) []byte {
+	var out bytes.Buffer
+	written := false
+	skipping := false
+	rest := data
+	for len(rest) > 0 {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+
+		// end of the headers
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			out.Write(line)
+			out.Write(rest)
+			break
+		}
+		isContinuation := line[0] == ' ' || line[0] == '\t'
+		if !isContinuation {
+			skipping = bytes.HasPrefix(bytes.ToLower(line), []byte("mw-int-rcpt-to:"))
+		}
+		if !skipping {
+			out.Write(line)
+			continue
+		}
+		if !written {
+			eol := line[len(bytes.TrimRight(line, "\r\n")):]
+			fmt.Fprintf(&out, "Mw-Int-Rcpt-To: %s%s", strings.Join(rcpts, ", "), eol)
+			written = true
+		}
+	}
+	return out.Bytes()
+}
+
+// rebufferEmail replaces the queued email with one only addressed to rcpts
+func rebufferEmail(file string, data []byte, rcpts []string) error {
+	// the rename has to stay on the same filesystem
+	tmp := path.Join(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if isQueueFile(file) {
+		// written outside of the queue so the retrier doesn't pick it up
+		// half written
+		if err := os.MkdirAll(RETRY_STATE_LOCATION, 0755); err != nil {
+			return errors.Wrapf(err, "could not create %s", RETRY_STATE_LOCATION)
+		}
+		tmp = path.Join(RETRY_STATE_LOCATION, filepath.Base(file)+".eml.tmp")
+	}
+	if err := ioutil.WriteFile(tmp, setRecipients(data, rcpts), 0644); err != nil {
+		return errors.Wrap(err, "could not write file")
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "could not replace file")
+	}
+	return nil
+}
+
+// recoverOptions changes how recoverEmail sends the email back
+type recoverOptions struct {
+	// sends to that via instead of the one in Mw-Int-Via
+	Via string
+	// keeps the file once the email has been sent back
+	Keep bool
+	// only prints what would be sent where
+	DryRun bool
+	// retry.yml and via.yml; read from conf.d if nil
+	Retry *retryConfig
+}
+
+func recoverEmail(file string, opts recoverOptions) error {
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
-		return errors.Wrap(err, "could not read file")
+		return &badEmailError{errors.Wrap(err, "could not read file")}
 	}
 
 	msg, err := mail.ReadMessage(bytes.NewReader(data))
 	if err != nil {
-		return errors.Wrap(err, "could not read message")
+		return &badEmailError{errors.Wrap(err, "could not read message")}
 	}
 
 	from := msg.Header.Get("Mw-Int-Mail-From")
-	to := msg.Header.Get("Mw-Int-Rcpt-To")
+	to := emailRecipients(msg.Header)
 	via := msg.Header.Get("Mw-Int-Via")
+	if opts.Via != "" {
+		via = opts.Via
+	}
 
-	if via == "forwarding" {
-		addr := fmt.Sprintf("127.0.0.1:%d", config.CurrConfig.PortForwarding)
-		err = smtp.SendMail(addr, nil, from, []string{to}, data)
-		if err != nil {
-			return errors.Wrap(err, "could not send email")
+	retryConf := opts.Retry
+	if retryConf == nil {
+		if retryConf, err = loadRetryConfig(); err != nil {
+			return err
 		}
+	}
+	if err := detectLoop(msg.Header, retryConf.loopMaxHops(via)); err != nil {
+		return err
+	}
 
-		// no failures detected so far means that the message has made it back into
-		// the system, we can go ahead and delete the file. If another error occur
-		// a new file will be created
-		if err := os.Remove(file); err != nil {
-			return errors.Wrap(err, "could not delete file")
+	if len(to) == 0 {
+		return &permanentError{Code: 554, Msg: "5.1.3 no recipient in Mw-Int-Rcpt-To"}
+	}
+
+	handler, err := retryConf.Handlers.lookup(via)
+	if err != nil {
+		return err
+	}
+
+	if opts.DryRun {
+		fmt.Printf("%s: %s -> %s via %s (%s)\n",
+			file, from, strings.Join(to, ", "), via, handler)
+		return nil
+	}
+
+	rejected, err := handler.deliver(from, to, data)
+	if err != nil {
+		err = sendError(err)
+		if _, ok := err.(*serviceDownError); !ok {
+			recordRetryAttempt(file, msg.Header, err)
 		}
-		log.Info("mail sent")
+		return err
+	}
+
+	failures := make([]deliveryFailure, 0)
+	deferred := make([]string, 0)
+	var firstPerm *permanentError
+	var firstDeferErr error
+	for _, rcpt := range to {
+		rcptErr, ok := rejected[rcpt]
+		if !ok {
+			continue
+		}
+		if perm, ok := sendError(rcptErr).(*permanentError); ok {
+			log.Warnf("%s rejected by %s: %s", rcpt, via, perm)
+			failure := perm.failure()
+			failure.Recipient = rcpt
+			failures = append(failures, failure)
+			if firstPerm == nil {
+				firstPerm = perm
+			}
+			continue
+		}
+		log.Warnf("%s deferred by %s: %s", rcpt, via, rcptErr)
+		deferred = append(deferred, rcpt)
+		if firstDeferErr == nil {
+			firstDeferErr = rcptErr
+		}
+	}
+
+	if len(failures) > 0 {
+		if err := sendDSN(data, failures); err != nil {
+			log.Errorf("failed to send DSN: %s", err)
+		}
+	}
+
+	switch {
+	case len(deferred) == len(to):
+		err := sendError(firstDeferErr)
+		recordRetryAttempt(file, msg.Header, err)
+		return err
+	case len(failures) == len(to):
+		recordRetryAttempt(file, msg.Header, firstPerm)
+		firstPerm.notified = true
+		return firstPerm
+	case len(deferred) > 0:
+		// only keep the recipients worth retrying so the others don't
+		// receive the email again
+		attemptErr := errors.Errorf("%d recipient(s) deferred: %s", len(deferred), firstDeferErr)
+		recordRetryAttempt(file, msg.Header, attemptErr)
+		if err := rebufferEmail(file, data, deferred); err != nil {
+			return errors.Wrap(err, "could not re-buffer deferred recipients")
+		}
+		log.Infof("mail sent via %s; %d recipient(s) deferred", via, len(deferred))
 		return nil
 	}
 
-	if via == "responder" {
-		addr := fmt.Sprintf("127.0.0.1:%d", config.CurrConfig.PortResponder)
-		err = smtp.SendMail(addr, nil, from, []string{to}, data)
+	recordRetryAttempt(file, msg.Header, nil)
+	if opts.Keep {
+		log.Infof("mail sent via %s; keeping %s", via, file)
+		return nil
+	}
+	// no failures detected so far means that the message has made it back into
+	// the system, we can go ahead and delete the file. If another error occur
+	// a new file will be created
+	if err := os.Remove(file); err != nil {
+		return errors.Wrap(err, "could not delete file")
+	}
+	log.Infof("mail sent via %s", via)
+	return nil
+}
+
+// recoverPaths expands the files, directories and globs given to recover into
+// the list of files to send back
+func recoverPaths(args []string) ([]string, error) {
+	files := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(file string) {
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	for _, arg := range args {
+		matches, err := filepath.Glob(arg)
 		if err != nil {
-			return errors.Wrap(err, "could not send email")
+			return nil, errors.Wrapf(err, "invalid pattern %s", arg)
+		}
+		if len(matches) == 0 {
+			return nil, errors.Errorf("%s: no such file or directory", arg)
 		}
 
-		// no failures detected so far means that the message has made it back into
-		// the system, we can go ahead and delete the file. If another error occur
-		// a new file will be created
-		if err := os.Remove(file); err != nil {
-			return errors.Wrap(err, "could not delete file")
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not stat %s", match)
+			}
+			if !info.IsDir() {
+				add(filepath.Clean(match))
+				continue
+			}
+			// not recursive; the queue has hold, dead and other
+			// directories that shouldn't be sent back
+			entries, err := ioutil.ReadDir(match)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read %s", match)
+			}
+			for _, entry := range entries {
+				if entry.Mode().IsRegular() {
+					add(path.Join(match, entry.Name()))
+				}
+			}
+		}
+	}
+	return files, nil
+}
+
+// recoverFiles sends back all the emails in args and reports how many failed
+func recoverFiles(args []string, opts recoverOptions) error {
+	files, err := recoverPaths(args)
+	if err != nil {
+		return err
+	}
+	defer smtpSessions.closeIdle(0)
+
+	if opts.Retry == nil {
+		if opts.Retry, err = loadRetryConfig(); err != nil {
+			return err
+		}
+	}
+
+	failed := 0
+	for _, file := range files {
+		unlock, err := lockQueueFile(file)
+		if err != nil {
+			log.Errorf("%s: %s", file, err)
+			failed++
+			continue
+		}
+		err = recoverEmail(file, opts)
+		unlock()
+		if err != nil {
+			log.Errorf("%s: %s", file, err)
+			failed++
 		}
-		log.Info("mail sent")
-		return nil
 	}
 
+	if opts.DryRun {
+		log.Infof("%d email(s) would be recovered, %d failed", len(files)-failed, failed)
+	} else {
+		log.Infof("%d email(s) recovered, %d failed", len(files)-failed, failed)
+	}
+	if failed > 0 {
+		return errors.Errorf("%d email(s) failed to recover", failed)
+	}
 	return nil
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEmailRecipients(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{"none", nil, []string{}},
+		{"one", []string{"a@example.com"}, []string{"a@example.com"}},
+		{"brackets", []string{"<a@example.com>"}, []string{"a@example.com"}},
+		{"list", []string{"<a@example.com>, b@example.com"}, []string{"a@example.com", "b@example.com"}},
+		{"repeated", []string{"a@example.com", "<b@example.com>,c@example.com"},
+			[]string{"a@example.com", "b@example.com", "c@example.com"}},
+		{"empty entries", []string{" , a@example.com,, <> "}, []string{"a@example.com"}},
+	}
+	for _, test := range tests {
+		header := mail.Header{}
+		if test.values != nil {
+			header["Mw-Int-Rcpt-To"] = test.values
+		}
+		if got := emailRecipients(header); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSetRecipients(t *testing.T) {
+	rcpts := []string{"a@example.com", "c@example.com"}
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			"single header",
+			"Subject: hi\nMw-Int-Rcpt-To: a@example.com, b@example.com\n\nbody\n",
+			"Subject: hi\nMw-Int-Rcpt-To: a@example.com, c@example.com\n\nbody\n",
+		},
+		{
+			"folded header",
+			"Mw-Int-Rcpt-To: a@example.com,\n b@example.com,\n\tc@example.com\nSubject: hi\n\nbody\n",
+			"Mw-Int-Rcpt-To: a@example.com, c@example.com\nSubject: hi\n\nbody\n",
+		},
+		{
+			"repeated headers",
+			"Mw-Int-Rcpt-To: a@example.com\nSubject: hi\nmw-int-rcpt-to: b@example.com\n\nbody\n",
+			"Mw-Int-Rcpt-To: a@example.com, c@example.com\nSubject: hi\n\nbody\n",
+		},
+		{
+			"CRLF",
+			"Mw-Int-Rcpt-To: a@example.com,\r\n b@example.com\r\nSubject: hi\r\n\r\nbody\r\n",
+			"Mw-Int-Rcpt-To: a@example.com, c@example.com\r\nSubject: hi\r\n\r\nbody\r\n",
+		},
+		{
+			"header in the body",
+			"Subject: hi\nMw-Int-Rcpt-To: b@example.com\n\nMw-Int-Rcpt-To: b@example.com\n",
+			"Subject: hi\nMw-Int-Rcpt-To: a@example.com, c@example.com\n\nMw-Int-Rcpt-To: b@example.com\n",
+		},
+	}
+	for _, test := range tests {
+		got := string(setRecipients([]byte(test.in), rcpts))
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+			continue
+		}
+		msg, err := mail.ReadMessage(strings.NewReader(got))
+		if err != nil {
+			t.Errorf("%s: could not read message: %s", test.name, err)
+			continue
+		}
+		if got := emailRecipients(msg.Header); !reflect.DeepEqual(got, rcpts) {
+			t.Errorf("%s: got recipients %q, want %q", test.name, got, rcpts)
+		}
+	}
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"runtime/debug"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// full scan of the queue in case the watcher missed something
+	RETRY_RESCAN_INTERVAL = 1 * time.Hour
+	// how often the throughput of the retrier is logged, when it did something
+	RETRY_REPORT_INTERVAL = 1 * time.Minute
+)
+
+type scheduledEmail struct {
+	id    string
+	via   string
+	due   time.Time
+	index int
+	// read again since it was due; it goes to the next worker as is
+	ready bool
+}
+
+// retrySchedule is a min-heap of queued emails by due time
+type retrySchedule struct {
+	items []*scheduledEmail
+	byId  map[string]*scheduledEmail
+}
+
+func newRetrySchedule() *retrySchedule {
+	return &retrySchedule{
+		items: make([]*scheduledEmail, 0),
+		byId:  make(map[string]*scheduledEmail),
+	}
+}
+
+func (s *retrySchedule) Len() int           { return len(s.items) }
+func (s *retrySchedule) Less(i, j int) bool { return s.items[i].due.Before(s.items[j].due) }
+func (s *retrySchedule) Swap(i, j int) {
+	s.items[i], s.items[j] = s.items[j], s.items[i]
+	s.items[i].index = i
+	s.items[j].index = j
+}
+
+func (s *retrySchedule) Push(x interface{}) {
+	item := x.(*scheduledEmail)
+	item.index = len(s.items)
+	s.items = append(s.items, item)
+	s.byId[item.id] = item
+}
+
+func (s *retrySchedule) Pop() interface{} {
+	n := len(s.items)
+	item := s.items[n-1]
+	s.items = s.items[:n-1]
+	delete(s.byId, item.id)
+	return item
+}
+
+func (s *retrySchedule) set(id string, via string, due time.Time) {
+	if item, ok := s.byId[id]; ok {
+		item.due = due
+		if via != "" {
+			item.via = via
+		}
+		heap.Fix(s, item.index)
+		return
+	}
+	heap.Push(s, &scheduledEmail{id: id, via: via, due: due})
+}
+
+func (s *retrySchedule) remove(id string) {
+	if item, ok := s.byId[id]; ok {
+		heap.Remove(s, item.index)
+	}
+}
+
+// untilNext returns how long to wait before the next email is due
+func (s *retrySchedule) untilNext() time.Duration {
+	if len(s.items) == 0 {
+		return RETRY_RESCAN_INTERVAL
+	}
+	d := time.Until(s.items[0].due)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// popDue removes and returns the next email if it is due
+func (s *retrySchedule) popDue(now time.Time) *scheduledEmail {
+	if len(s.items) == 0 || s.items[0].due.After(now) {
+		return nil
+	}
+	return heap.Pop(s).(*scheduledEmail)
+}
+
+type retryResult struct {
+	id      string
+	via     string
+	outcome retryOutcome
+	err     error
+	// the email ran out of retries and was being dead-lettered
+	giveUp bool
+}
+
+type retrier struct {
+	conf *retryConfig
+	// the queue and how its emails are sent back; replaced in the tests
+	dir   string
+	retry func(abspath string, conf *retryConfig) (retryOutcome, error)
+
+	schedule *retrySchedule
+	// retry states of emails that left the queue, by Mw-Int-Id
+	orphans map[string]*retryState
+
+	// emails being retried by the workers, by id and count by via
+	inFlight    map[string]string
+	inFlightVia map[string]int
+	// due emails waiting for a worker of their via, or for their previous
+	// attempt to finish
+	blocked []*scheduledEmail
+	done    chan retryResult
+
+	// attempts since the last report
+	succeeded    int
+	failed       int
+	deadLettered int
+	quarantined  int
+	reportSince  time.Time
+}
+
+func newRetrier(conf *retryConfig) *retrier {
+	return &retrier{
+		conf:        conf,
+		dir:         config.RUNTIME_LOCATION,
+		retry:       safeRetryEmail,
+		inFlight:    make(map[string]string),
+		inFlightVia: make(map[string]int),
+		blocked:     make([]*scheduledEmail, 0),
+		done:        make(chan retryResult),
+		reportSince: time.Now(),
+	}
+}
+
+// scan rebuilds the schedule from the content of the queue
+func (r *retrier) scan() error {
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", r.dir)
+	}
+	orphans, err := loadOrphanRetryStates()
+	if err != nil {
+		return err
+	}
+
+	r.orphans = orphans
+	r.schedule = newRetrySchedule()
+	r.blocked = r.blocked[:0]
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		r.scheduleEmail(file.Name())
+	}
+	log.Infof("%d email(s) in the retry queue", r.schedule.Len())
+	return nil
+}
+
+// scheduleEmail computes when the email should be retried next and adds it
+// to the schedule. It returns false if the email is not in the queue anymore.
+func (r *retrier) scheduleEmail(id string) (time.Time, bool) {
+	abspath := path.Join(r.dir, id)
+	file, err := os.Stat(abspath)
+	if err != nil || file.IsDir() {
+		r.schedule.remove(id)
+		return time.Time{}, false
+	}
+
+	// ensures that the file has been in the queue for long enough
+	minDue := file.ModTime().Add(r.conf.Interval)
+	via := ""
+
+	var msg *mail.Message
+	data, err := ioutil.ReadFile(abspath)
+	if err == nil {
+		msg, err = mail.ReadMessage(bytes.NewReader(data))
+	}
+	if err != nil {
+		// the file might still be being written; only give up on it once
+		// it settled
+		if time.Now().Before(minDue) {
+			log.Debugf("could not read %s yet: %s", abspath, err)
+			r.schedule.set(id, via, minDue)
+			return minDue, true
+		}
+		if err := quarantineEmail(abspath, "unreadable email: "+err.Error()); err != nil {
+			log.Errorf("could not quarantine %s: %s", abspath, err)
+			due := time.Now().Add(r.conf.Interval)
+			r.schedule.set(id, via, due)
+			return due, true
+		}
+		r.schedule.remove(id)
+		return time.Time{}, false
+	}
+	via = msg.Header.Get("Mw-Int-Via")
+	if _, err := r.conf.Handlers.lookup(via); err != nil {
+		if _, ok := err.(*unknownViaError); ok {
+			r.schedule.remove(id)
+			if err := quarantineEmail(abspath, err.Error()); err != nil {
+				log.Errorf("could not quarantine %s: %s", abspath, err)
+			}
+			return time.Time{}, false
+		}
+		log.Errorf("could not find handler for %s: %s", abspath, err)
+	}
+	state, err := getRetryState(id, msg.Header, file.ModTime(), r.orphans)
+	if err != nil {
+		log.Errorf("could not get retry state of %s: %s", abspath, err)
+		r.schedule.set(id, via, minDue)
+		return minDue, true
+	}
+
+	policy := r.conf.policyFor(via)
+	nextRetry, err := getNextRetry(policy, state)
+	if err != nil {
+		log.Errorf("could not retry: %s", err)
+		r.schedule.remove(id)
+		r.giveUp(id, via, err.Error())
+		return time.Time{}, false
+	}
+
+	if state.NextDue == nil || !state.NextDue.Equal(nextRetry) {
+		state.NextDue = &nextRetry
+		if err := state.save(); err != nil {
+			log.Warn(err)
+		}
+	}
+
+	if nextRetry.Before(minDue) {
+		nextRetry = minDue
+	}
+	log.Debugf("%s retried %d time(s) next retry in %v",
+		abspath, len(state.Attempts), time.Until(nextRetry).Round(time.Second))
+	r.schedule.set(id, via, nextRetry)
+	return nextRetry, true
+}
+
+// forget removes an email that left the queue from the schedule and keeps
+// its state around in case the services buffer it again
+func (r *retrier) forget(id string) {
+	r.schedule.remove(id)
+	if isQueued(id) {
+		return
+	}
+	state, err := readRetryState(id)
+	if err != nil || state == nil {
+		return
+	}
+	for _, mailId := range state.MailIds {
+		r.orphans[mailId] = state
+	}
+}
+
+func (r *retrier) handleEvent(event fsnotify.Event) {
+	id := path.Base(event.Name)
+	switch {
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		r.forget(id)
+	case event.Op&(fsnotify.Create|fsnotify.Write) != 0:
+		// the file is only read once it settled, it might still be
+		// being written
+		if fileExists(event.Name) {
+			r.schedule.set(id, "", time.Now().Add(r.conf.Interval))
+		}
+	}
+}
+
+// hasCapacity reports whether a worker is available for the via
+func (r *retrier) hasCapacity(via string) bool {
+	if len(r.inFlight) >= r.conf.Concurrency {
+		return false
+	}
+	return r.inFlightVia[via] < r.conf.concurrencyFor(via)
+}
+
+// untilNext returns how long to wait before handing emails to the workers;
+// when all of them are busy finish does it as soon as one is available
+func (r *retrier) untilNext() time.Duration {
+	if len(r.inFlight) >= r.conf.Concurrency {
+		return RETRY_RESCAN_INTERVAL
+	}
+	return r.schedule.untilNext()
+}
+
+// retryDue hands the emails that are due to the workers, as long as the
+// concurrency limits allow it. Emails are only read again once a worker can
+// take them.
+func (r *retrier) retryDue() {
+	// the blocked emails were due first
+	blocked := r.blocked
+	r.blocked = make([]*scheduledEmail, 0, len(blocked))
+	for _, item := range blocked {
+		r.tryDispatch(item)
+	}
+
+	now := time.Now()
+	for len(r.inFlight) < r.conf.Concurrency {
+		item := r.schedule.popDue(now)
+		if item == nil {
+			break
+		}
+		r.tryDispatch(item)
+	}
+}
+
+// tryDispatch hands a due email to a worker, or blocks it until one of its
+// via is available
+func (r *retrier) tryDispatch(item *scheduledEmail) {
+	// at most one attempt per email at a time
+	if _, ok := r.inFlight[item.id]; ok || !r.hasCapacity(item.via) {
+		r.blocked = append(r.blocked, item)
+		return
+	}
+	id := item.id
+	if !fileExists(path.Join(r.dir, id)) {
+		r.forget(id)
+		return
+	}
+
+	if !item.ready {
+		// the retry history might have changed since it was scheduled
+		due, ok := r.scheduleEmail(id)
+		if !ok || due.After(time.Now()) {
+			return
+		}
+		item = r.schedule.byId[id]
+		r.schedule.remove(id)
+		item.ready = true
+
+		// the via is only known for sure once the email was read
+		if !r.hasCapacity(item.via) {
+			r.blocked = append(r.blocked, item)
+			return
+		}
+	}
+	r.dispatch(item)
+}
+
+func (r *retrier) dispatch(item *scheduledEmail) {
+	r.schedule.remove(item.id)
+	r.inFlight[item.id] = item.via
+	r.inFlightVia[item.via]++
+
+	go func(id, via string, conf *retryConfig) {
+		abspath := path.Join(r.dir, id)
+		retryCount := 0
+		if state, _ := readRetryState(id); state != nil {
+			retryCount = len(state.Attempts)
+		}
+		log.Infof("%s retried %d time(s), retyring now", abspath, retryCount)
+		outcome, err := r.retry(abspath, conf)
+		r.done <- retryResult{id, via, outcome, err, false}
+	}(item.id, item.via, r.conf)
+}
+
+// giveUp dead-letters the email in a worker, since notifying the sender goes
+// through mailout and can take as long as a retry
+func (r *retrier) giveUp(id, via, reason string) {
+	// the attempt in flight schedules it again once done
+	if _, ok := r.inFlight[id]; ok {
+		return
+	}
+	r.inFlight[id] = via
+	r.inFlightVia[via]++
+
+	go func() {
+		outcome, err := parked(retryDeadLettered,
+			giveUpEmail(path.Join(r.dir, id), reason))
+		r.done <- retryResult{id, via, outcome, err, true}
+	}()
+}
+
+// safeRetryEmail retries the email and quarantines it if that panics, so
+// that one email can't bring the retrier down
+func safeRetryEmail(abspath string, conf *retryConfig) (outcome retryOutcome, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Errorf("panic while retrying %s: %v\n%s", abspath, p, debug.Stack())
+			outcome, err = parked(retryQuarantined,
+				quarantineEmail(abspath, fmt.Sprintf("panic while retrying: %v", p)))
+		}
+	}()
+	return retryEmail(abspath, conf)
+}
+
+// finish records the end of an attempt and hands the due emails to the
+// worker that became available
+func (r *retrier) finish(res retryResult) {
+	delete(r.inFlight, res.id)
+	r.inFlightVia[res.via]--
+
+	// the retry history of the email decides when it is tried again, not
+	// the due time it had when it was blocked
+	blocked := r.blocked[:0]
+	for _, item := range r.blocked {
+		if item.id != res.id {
+			blocked = append(blocked, item)
+		}
+	}
+	r.blocked = blocked
+
+	if res.giveUp && res.err != nil {
+		log.Errorf("could not give up %s: %s", res.id, res.err)
+		r.schedule.set(res.id, res.via, time.Now().Add(r.conf.Interval))
+		r.retryDue()
+		return
+	}
+
+	if res.err != errQueueFileLocked {
+		metrics.recordRetry(res.via, res.outcome)
+	}
+
+	switch res.err.(type) {
+	case nil:
+		switch res.outcome {
+		case retrySent:
+			r.succeeded++
+		case retryDeadLettered:
+			r.deadLettered++
+		case retryQuarantined:
+			r.quarantined++
+		}
+	case *serviceDownError:
+		log.Warnf("%s not retried: %s", res.id, res.err)
+	default:
+		if res.err == errQueueFileLocked {
+			log.Infof("%s is being processed elsewhere; skipping", res.id)
+		} else {
+			log.Errorf("failed to retry %s: %s", res.id, res.err)
+			r.failed++
+		}
+	}
+
+	// still in the queue; the retry history decides when to try again
+	if due, ok := r.scheduleEmail(res.id); ok && !due.After(time.Now()) {
+		r.schedule.set(res.id, res.via, time.Now().Add(r.conf.Interval))
+	}
+	r.retryDue()
+}
+
+// reload reads the retry config again and rebuilds the schedule
+func (r *retrier) reload() error {
+	if c, err := loadRetryConfig(); err != nil {
+		log.Errorf("could not reload retry config, keeping previous one: %s", err)
+	} else {
+		r.conf = c
+	}
+	return r.scan()
+}
+
+// shutdown waits for the emails being retried. Past SHUTDOWN_TIMEOUT the
+// deliveries are aborted; the emails stay in the queue since they are only
+// deleted once accepted.
+func (r *retrier) shutdown() {
+	if len(r.inFlight) == 0 {
+		return
+	}
+	log.Infof("waiting for %d email(s) being retried", len(r.inFlight))
+	timeout := time.After(SHUTDOWN_TIMEOUT)
+	aborted := false
+	for len(r.inFlight) > 0 {
+		select {
+		case res := <-r.done:
+			delete(r.inFlight, res.id)
+			if res.err != nil {
+				log.Warnf("%s: %s", res.id, res.err)
+			}
+		case <-timeout:
+			if aborted {
+				log.Warnf("giving up on %d email(s) being retried", len(r.inFlight))
+				return
+			}
+			log.Warnf("aborting %d email(s) being retried", len(r.inFlight))
+			smtpSessions.abort()
+			aborted = true
+			timeout = time.After(VIA_DIAL_TIMEOUT)
+		}
+	}
+}
+
+// report logs how many emails were retried since the last report
+func (r *retrier) report() {
+	elapsed := time.Since(r.reportSince)
+	if total := r.succeeded + r.failed + r.deadLettered + r.quarantined; total > 0 {
+		log.Infof("retried %d email(s) in %v (%.1f/s): %d succeeded, %d failed, "+
+			"%d dead-lettered, %d quarantined, %d still queued",
+			total, elapsed.Round(time.Second), float64(total)/elapsed.Seconds(),
+			r.succeeded, r.failed, r.deadLettered, r.quarantined,
+			r.schedule.Len()+len(r.blocked)+len(r.inFlight))
+	}
+	r.succeeded = 0
+	r.failed = 0
+	r.deadLettered = 0
+	r.quarantined = 0
+	r.reportSince = time.Now()
+}
+
+// superviseMailoutRetrier retries the queued emails until ctx is done. A
+// value on reload makes it read its config again.
+func superviseMailoutRetrier(ctx context.Context, reload <-chan struct{}) error {
+	retryConf, err := loadRetryConfig()
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "could not create new watcher")
+	}
+	defer watcher.Close()
+	if err := watcher.Add(config.RUNTIME_LOCATION); err != nil {
+		return errors.Wrapf(err, "failed to watch %s", config.RUNTIME_LOCATION)
+	}
+
+	r := newRetrier(retryConf)
+	if err := r.scan(); err != nil {
+		return err
+	}
+
+	log.Info("mailout retrier running")
+	timer := time.NewTimer(r.untilNext())
+	rescan := time.NewTicker(RETRY_RESCAN_INTERVAL)
+	defer rescan.Stop()
+	report := time.NewTicker(RETRY_REPORT_INTERVAL)
+	defer report.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			r.handleEvent(event)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			// events might have been lost
+			log.Errorf("error while watching queue: %s; rescanning", err)
+			if err := r.scan(); err != nil {
+				return err
+			}
+		case <-rescan.C:
+			if err := r.reload(); err != nil {
+				return err
+			}
+		case <-reload:
+			log.Info("reloading retry config")
+			if err := r.reload(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			log.Info("mailout retrier stopping")
+			r.shutdown()
+			return nil
+		case res := <-r.done:
+			r.finish(res)
+		case <-report.C:
+			r.report()
+			smtpSessions.closeIdle(SMTP_SESSION_IDLE_TIMEOUT)
+		case <-timer.C:
+			r.retryDue()
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(r.untilNext())
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRetrySchedule(t *testing.T) {
+	now := time.Now()
+	s := newRetrySchedule()
+	if d := s.untilNext(); d != RETRY_RESCAN_INTERVAL {
+		t.Errorf("empty schedule: got %v, want %v", d, RETRY_RESCAN_INTERVAL)
+	}
+
+	s.set("c", "forwarding", now.Add(-1*time.Minute))
+	s.set("a", "forwarding", now.Add(-3*time.Minute))
+	s.set("later", "forwarding", now.Add(time.Hour))
+	s.set("b", "forwarding", now.Add(-2*time.Minute))
+	// rescheduled before a; the via is kept when unknown
+	s.set("d", "responder", now.Add(time.Hour))
+	s.set("d", "", now.Add(-4*time.Minute))
+	s.remove("c")
+	s.remove("unknown")
+
+	if d := s.untilNext(); d != 0 {
+		t.Errorf("overdue schedule: got %v, want 0", d)
+	}
+	want := []string{"d", "a", "b"}
+	for _, id := range want {
+		item := s.popDue(now)
+		if item == nil {
+			t.Fatalf("expected %s, got nothing", id)
+		}
+		if item.id != id {
+			t.Errorf("got %s, want %s", item.id, id)
+		}
+		if item.id == "d" && item.via != "responder" {
+			t.Errorf("d: got via %q, want responder", item.via)
+		}
+	}
+	if item := s.popDue(now); item != nil {
+		t.Errorf("got %s, nothing else is due", item.id)
+	}
+	if s.Len() != 1 || s.byId["later"] == nil {
+		t.Errorf("expected only later to be left, got %d item(s)", s.Len())
+	}
+}
+
+// testQueue redirects the queue and the directories around it to a temporary
+// directory
+type testQueue struct {
+	t   *testing.T
+	dir string
+
+	stateLocation      string
+	deadLetterLocation string
+	quarantineLocation string
+}
+
+func newTestQueue(t *testing.T) *testQueue {
+	dir, err := ioutil.TempDir("", "mailway-retrier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := &testQueue{
+		t:                  t,
+		dir:                dir,
+		stateLocation:      RETRY_STATE_LOCATION,
+		deadLetterLocation: DEAD_LETTER_LOCATION,
+		quarantineLocation: QUARANTINE_LOCATION,
+	}
+	RETRY_STATE_LOCATION = path.Join(dir, "meta")
+	DEAD_LETTER_LOCATION = path.Join(dir, "dead")
+	QUARANTINE_LOCATION = path.Join(dir, "quarantine")
+	return q
+}
+
+func (q *testQueue) close() {
+	RETRY_STATE_LOCATION = q.stateLocation
+	DEAD_LETTER_LOCATION = q.deadLetterLocation
+	QUARANTINE_LOCATION = q.quarantineLocation
+	os.RemoveAll(q.dir)
+}
+
+// add queues an email that has been waiting for age
+func (q *testQueue) add(id, via string, age time.Duration) {
+	data := fmt.Sprintf("Mw-Int-Id: %s-1\r\nMw-Int-Via: %s\r\nMw-Int-Rcpt-To: <a@example.com>\r\n"+
+		"Subject: test\r\n\r\nbody\r\n", id, via)
+	abspath := path.Join(q.dir, id)
+	if err := ioutil.WriteFile(abspath, []byte(data), 0644); err != nil {
+		q.t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(abspath, modTime, modTime); err != nil {
+		q.t.Fatal(err)
+	}
+}
+
+// stubRetry replaces the deliveries of the retrier; each email waits for its
+// outcome on release and is removed from the queue once sent
+type stubRetry struct {
+	started chan string
+	release map[string]chan error
+}
+
+func newStubRetry(ids ...string) *stubRetry {
+	s := &stubRetry{
+		started: make(chan string, len(ids)),
+		release: make(map[string]chan error),
+	}
+	for _, id := range ids {
+		s.release[id] = make(chan error, 1)
+	}
+	return s
+}
+
+func (s *stubRetry) retry(abspath string, conf *retryConfig) (retryOutcome, error) {
+	id := path.Base(abspath)
+	s.started <- id
+	if err := <-s.release[id]; err != nil {
+		return retryQueued, err
+	}
+	os.Remove(abspath)
+	return retrySent, nil
+}
+
+func testRetryConfig() *retryConfig {
+	target := viaTarget{Type: "smtp", Address: "127.0.0.1:1"}
+	return &retryConfig{
+		Interval: time.Second,
+		Policy: retryPolicy{
+			Sequence:    []time.Duration{time.Minute},
+			MaxAttempts: 3,
+		},
+		Concurrency:    2,
+		ConcurrencyVia: map[string]int{"slow": 1},
+		Handlers: &viaConfig{Handlers: map[string]viaTarget{
+			"fast": target,
+			"slow": target,
+		}},
+	}
+}
+
+func newTestRetrier(q *testQueue, stub *stubRetry) *retrier {
+	r := newRetrier(testRetryConfig())
+	r.dir = q.dir
+	r.retry = stub.retry
+	if err := r.scan(); err != nil {
+		q.t.Fatal(err)
+	}
+	return r
+}
+
+func inFlightIds(r *retrier) []string {
+	ids := make([]string, 0)
+	for id := range r.inFlight {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func expectInFlight(t *testing.T, r *retrier, want ...string) {
+	t.Helper()
+	sort.Strings(want)
+	if got := inFlightIds(r); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("in flight: got %v, want %v", got, want)
+	}
+}
+
+// finishOne lets the email go with err and waits for its result
+func finishOne(t *testing.T, r *retrier, stub *stubRetry, id string, err error) retryResult {
+	t.Helper()
+	stub.release[id] <- err
+	res := <-r.done
+	if res.id != id {
+		t.Fatalf("got result of %s, want %s", res.id, id)
+	}
+	r.finish(res)
+	return res
+}
+
+func TestRetryDueConcurrency(t *testing.T) {
+	q := newTestQueue(t)
+	defer q.close()
+	q.add("slow1", "slow", 60*time.Minute)
+	q.add("slow2", "slow", 59*time.Minute)
+	q.add("fast1", "fast", 58*time.Minute)
+	q.add("fast2", "fast", 57*time.Minute)
+	q.add("fast3", "fast", 56*time.Minute)
+
+	stub := newStubRetry("slow1", "slow2", "fast1", "fast2", "fast3")
+	r := newTestRetrier(q, stub)
+	r.retryDue()
+
+	// slow2 waits for slow1 without being read again, and nothing else is
+	// taken off the schedule once all the workers are busy
+	expectInFlight(t, r, "slow1", "fast1")
+	if len(r.blocked) != 1 || r.blocked[0].id != "slow2" || r.blocked[0].ready {
+		t.Fatalf("blocked: got %+v, want slow2 not read yet", r.blocked)
+	}
+	if r.schedule.Len() != 2 {
+		t.Errorf("schedule: got %d item(s), want fast2 and fast3", r.schedule.Len())
+	}
+	if d := r.untilNext(); d != RETRY_RESCAN_INTERVAL {
+		t.Errorf("all workers busy: got %v, want %v", d, RETRY_RESCAN_INTERVAL)
+	}
+
+	// slow is still busy, fast2 takes the worker
+	finishOne(t, r, stub, "fast1", nil)
+	expectInFlight(t, r, "slow1", "fast2")
+	if len(r.blocked) != 1 || r.blocked[0].id != "slow2" {
+		t.Fatalf("blocked: got %+v, want slow2", r.blocked)
+	}
+
+	// slow2 goes before fast3 since it was due first
+	finishOne(t, r, stub, "slow1", nil)
+	expectInFlight(t, r, "fast2", "slow2")
+	if len(r.blocked) != 0 {
+		t.Errorf("blocked: got %+v, want none", r.blocked)
+	}
+
+	finishOne(t, r, stub, "fast2", nil)
+	expectInFlight(t, r, "slow2", "fast3")
+	finishOne(t, r, stub, "slow2", nil)
+	finishOne(t, r, stub, "fast3", nil)
+	expectInFlight(t, r)
+	if r.succeeded != 5 || r.schedule.Len() != 0 {
+		t.Errorf("got %d succeeded and %d scheduled, want 5 and 0",
+			r.succeeded, r.schedule.Len())
+	}
+}
+
+func TestRetryDueOneAttemptPerEmail(t *testing.T) {
+	q := newTestQueue(t)
+	defer q.close()
+	q.add("email", "fast", time.Hour)
+
+	stub := newStubRetry("email")
+	r := newTestRetrier(q, stub)
+	r.retryDue()
+	expectInFlight(t, r, "email")
+
+	// the services write it again while it is being retried
+	r.schedule.set("email", "", time.Now().Add(-time.Second))
+	r.retryDue()
+	expectInFlight(t, r, "email")
+	if len(r.blocked) != 1 {
+		t.Fatalf("blocked: got %+v, want email", r.blocked)
+	}
+	select {
+	case id := <-stub.started:
+		if id != "email" {
+			t.Fatalf("unexpected attempt for %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("email was not retried")
+	}
+
+	res := finishOne(t, r, stub, "email", errors.New("451 try again later"))
+	if res.outcome != retryQueued || r.failed != 1 {
+		t.Errorf("got %s and %d failed, want queued and 1", res.outcome, r.failed)
+	}
+	// the blocked copy is dropped; the next attempt waits for the interval
+	expectInFlight(t, r)
+	if len(r.blocked) != 0 {
+		t.Errorf("blocked: got %+v, want none", r.blocked)
+	}
+	item := r.schedule.byId["email"]
+	if item == nil || !item.due.After(time.Now()) {
+		t.Fatalf("email should be scheduled later, got %+v", item)
+	}
+	select {
+	case id := <-stub.started:
+		t.Errorf("%s retried twice", id)
+	default:
+	}
+}
+
+func TestFinishServiceDown(t *testing.T) {
+	q := newTestQueue(t)
+	defer q.close()
+	q.add("email", "fast", time.Hour)
+
+	stub := newStubRetry("email")
+	r := newTestRetrier(q, stub)
+	r.retryDue()
+	expectInFlight(t, r, "email")
+
+	res := finishOne(t, r, stub, "email", &serviceDownError{errors.New("connection refused")})
+	if res.outcome != retryQueued {
+		t.Errorf("got %s, want queued", res.outcome)
+	}
+	// not an attempt; tried again after the interval
+	if r.failed != 0 || r.succeeded != 0 {
+		t.Errorf("got %d failed and %d succeeded, want none", r.failed, r.succeeded)
+	}
+	item := r.schedule.byId["email"]
+	if item == nil {
+		t.Fatal("email is not scheduled anymore")
+	}
+	if d := time.Until(item.due); d <= 0 || d > r.conf.Interval {
+		t.Errorf("email due in %v, want within %v", d, r.conf.Interval)
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	q := newTestQueue(t)
+	defer q.close()
+	q.add("email", "fast", time.Hour)
+
+	state := &retryState{Id: "email", MailIds: []string{"email-1"}, FirstSeen: time.Now().Add(-time.Hour)}
+	for i := 0; i < testRetryConfig().Policy.MaxAttempts; i++ {
+		state.recordAttempt(errors.New("451 try again later"))
+	}
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	stub := newStubRetry()
+	r := newTestRetrier(q, stub)
+	// dead-lettered by a worker, not by the scan
+	expectInFlight(t, r, "email")
+	if r.schedule.Len() != 0 {
+		t.Errorf("schedule: got %d item(s), want none", r.schedule.Len())
+	}
+
+	res := <-r.done
+	if !res.giveUp || res.err != nil || res.outcome != retryDeadLettered {
+		t.Fatalf("got %+v, want a dead-lettered email", res)
+	}
+	r.finish(res)
+	expectInFlight(t, r)
+	if r.deadLettered != 1 {
+		t.Errorf("got %d dead-lettered, want 1", r.deadLettered)
+	}
+	if !fileExists(path.Join(DEAD_LETTER_LOCATION, "email")) {
+		t.Errorf("email is not in %s", DEAD_LETTER_LOCATION)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	DEFAULT_RETRY_INTERVAL    = 3 * time.Minute
+	DEFAULT_RETRY_CONCURRENCY = 4
+	// Fibonacci sequence in multiples of DEFAULT_RETRY_INTERVAL
+	DEFAULT_RETRY_SEQ = []int{0, 1, 1, 2, 3, 5, 8, 13, 21, 34, 55, 89, 144,
+		233, 377, 610, 987, 1597, 2584, 4181}
+)
+
+type retryPolicy struct {
+	// delay before the first retry, multiplied by Multiplier for every
+	// following attempt. Ignored if Sequence is set.
+	InitialDelay time.Duration `yaml:"initial_delay"`
+	Multiplier   float64       `yaml:"multiplier"`
+	// explicit delay before each attempt
+	Sequence []time.Duration `yaml:"sequence"`
+	// fraction of the delay randomly added or removed
+	Jitter      float64       `yaml:"jitter"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	MaxAge      time.Duration `yaml:"max_age"`
+}
+
+// retry.yml in conf.d
+type retryConfig struct {
+	Interval time.Duration          `yaml:"retry_interval"`
+	Policy   retryPolicy            `yaml:"retry_policy"`
+	Via      map[string]retryPolicy `yaml:"retry_policy_via"`
+
+	// maximum number of emails retried at the same time, overall and by via
+	Concurrency    int            `yaml:"retry_concurrency"`
+	ConcurrencyVia map[string]int `yaml:"retry_concurrency_via"`
+
+	// maximum number of Mw-Int-Id headers before an email is considered
+	// looping; max_attempts plus LOOP_HOPS_MARGIN by default
+	LoopMaxHops int `yaml:"retry_loop_max_hops"`
+
+	// via.yml, read along so that it isn't parsed for every email
+	Handlers *viaConfig `yaml:"-"`
+}
+
+func defaultRetryPolicy() retryPolicy {
+	seq := make([]time.Duration, len(DEFAULT_RETRY_SEQ))
+	for i, n := range DEFAULT_RETRY_SEQ {
+		seq[i] = time.Duration(n) * DEFAULT_RETRY_INTERVAL
+	}
+	return retryPolicy{
+		Sequence:    seq,
+		MaxAttempts: len(seq),
+	}
+}
+
+func loadRetryConfig() (*retryConfig, error) {
+	var c retryConfig
+	if err := loadConf(&c); err != nil {
+		return nil, errors.Wrap(err, "could not load retry config")
+	}
+	handlers, err := loadViaConfig()
+	if err != nil {
+		return nil, err
+	}
+	c.Handlers = handlers
+	if c.Interval <= 0 {
+		c.Interval = DEFAULT_RETRY_INTERVAL
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = DEFAULT_RETRY_CONCURRENCY
+	}
+
+	p := &c.Policy
+	if len(p.Sequence) == 0 && p.InitialDelay == 0 {
+		def := defaultRetryPolicy()
+		p.Sequence = def.Sequence
+		if p.MaxAttempts == 0 {
+			p.MaxAttempts = def.MaxAttempts
+		}
+	}
+	if p.MaxAttempts == 0 {
+		if len(p.Sequence) > 0 {
+			p.MaxAttempts = len(p.Sequence)
+		} else {
+			p.MaxAttempts = len(DEFAULT_RETRY_SEQ)
+		}
+	}
+	if err := p.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid retry_policy")
+	}
+	if err := c.validateLoopMaxHops(*p); err != nil {
+		return nil, errors.Wrap(err, "invalid retry_policy")
+	}
+	for via := range c.Via {
+		p := c.policyFor(via)
+		if err := p.validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid retry_policy_via.%s", via)
+		}
+		if err := c.validateLoopMaxHops(p); err != nil {
+			return nil, errors.Wrapf(err, "invalid retry_policy_via.%s", via)
+		}
+	}
+	return &c, nil
+}
+
+func (p retryPolicy) validate() error {
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.Errorf("jitter must be between 0 and 1, got %v", p.Jitter)
+	}
+	if p.Multiplier < 0 {
+		return errors.Errorf("multiplier must be positive, got %v", p.Multiplier)
+	}
+	if p.MaxAttempts < 0 {
+		return errors.Errorf("max_attempts must be positive, got %d", p.MaxAttempts)
+	}
+	return nil
+}
+
+// validateLoopMaxHops makes sure that the emails reach max_attempts before
+// the loop detection quarantines them
+func (c *retryConfig) validateLoopMaxHops(p retryPolicy) error {
+	if c.LoopMaxHops > 0 && c.LoopMaxHops <= p.MaxAttempts {
+		return errors.Errorf("max_attempts (%d) must be below retry_loop_max_hops (%d)",
+			p.MaxAttempts, c.LoopMaxHops)
+	}
+	return nil
+}
+
+// concurrencyFor returns how many emails of the via can be retried at the
+// same time
+func (c *retryConfig) concurrencyFor(via string) int {
+	if n, ok := c.ConcurrencyVia[via]; ok && n > 0 && n < c.Concurrency {
+		return n
+	}
+	return c.Concurrency
+}
+
+// policyFor returns the retry policy with the overrides of the via applied
+func (c *retryConfig) policyFor(via string) retryPolicy {
+	p := c.Policy
+	o, ok := c.Via[via]
+	if !ok {
+		return p
+	}
+
+	if len(o.Sequence) > 0 || o.InitialDelay != 0 {
+		p.Sequence = o.Sequence
+		p.InitialDelay = o.InitialDelay
+		p.Multiplier = o.Multiplier
+	}
+	if o.Jitter != 0 {
+		p.Jitter = o.Jitter
+	}
+	if o.MaxAttempts != 0 {
+		p.MaxAttempts = o.MaxAttempts
+	}
+	if o.MaxAge != 0 {
+		p.MaxAge = o.MaxAge
+	}
+	return p
+}
+
+// delay returns how long to wait after the previous attempt before the given
+// attempt (starting at 1)
+func (p retryPolicy) delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	var d time.Duration
+	if len(p.Sequence) > 0 {
+		if attempt > len(p.Sequence) {
+			d = p.Sequence[len(p.Sequence)-1]
+		} else {
+			d = p.Sequence[attempt-1]
+		}
+	} else {
+		multiplier := p.Multiplier
+		if multiplier == 0 {
+			multiplier = 1
+		}
+		d = time.Duration(float64(p.InitialDelay) * math.Pow(multiplier, float64(attempt-1)))
+	}
+	return d
+}
+
+// jitter returns a stable offset for the given email and attempt so that the
+// next retry time doesn't move between two scans of the queue
+func (p retryPolicy) jitter(id string, attempt int, d time.Duration) time.Duration {
+	if p.Jitter == 0 || d == 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s:%d", id, attempt)
+	r := float64(h.Sum64()%10000) / 10000
+	return time.Duration(float64(d) * p.Jitter * (r*2 - 1))
+}
+
+func getNextRetry(policy retryPolicy, state *retryState) (time.Time, error) {
+	retry := state.retries()
+	if retry > policy.MaxAttempts {
+		return time.Time{}, errors.Errorf("too many retries (%d), ignoring", retry)
+	}
+	if policy.MaxAge > 0 && time.Since(state.FirstSeen) > policy.MaxAge {
+		return time.Time{}, errors.Errorf("queued for longer than %v, ignoring", policy.MaxAge)
+	}
+	d := policy.delay(retry)
+	return state.lastAttempt().Add(d + policy.jitter(state.Id, retry, d)), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func stateWithAttempts(n int, last time.Time) *retryState {
+	state := &retryState{Id: "test", FirstSeen: last.Add(-time.Hour)}
+	for i := 0; i < n; i++ {
+		state.Attempts = append(state.Attempts, retryAttempt{At: last})
+	}
+	return state
+}
+
+func TestGetNextRetry(t *testing.T) {
+	last := time.Now().Add(-time.Minute)
+	policy := retryPolicy{
+		Sequence:    []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute},
+		MaxAttempts: 3,
+	}
+
+	tests := []struct {
+		name     string
+		attempts int
+		maxAge   time.Duration
+		want     time.Duration
+		wantErr  bool
+	}{
+		{"first retry", 0, 0, time.Minute, false},
+		{"second retry", 1, 0, 2 * time.Minute, false},
+		{"last allowed retry", 2, 0, 3 * time.Minute, false},
+		{"max_attempts reached", 3, 0, 0, true},
+		{"past max_attempts", 4, 0, 0, true},
+		{"too old", 0, 30 * time.Minute, 0, true},
+		{"not too old", 0, 2 * time.Hour, time.Minute, false},
+	}
+	for _, test := range tests {
+		p := policy
+		p.MaxAge = test.maxAge
+		got, err := getNextRetry(p, stateWithAttempts(test.attempts, last))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		start := last
+		if test.attempts == 0 {
+			start = last.Add(-time.Hour)
+		}
+		if want := start.Add(test.want); !got.Equal(want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, want)
+		}
+	}
+}
+
+func TestPolicyFor(t *testing.T) {
+	seq := []time.Duration{time.Minute, time.Hour}
+	c := &retryConfig{
+		Policy: retryPolicy{
+			Sequence:    seq,
+			Jitter:      0.1,
+			MaxAttempts: 20,
+			MaxAge:      72 * time.Hour,
+		},
+		Via: map[string]retryPolicy{
+			"attempts": {MaxAttempts: 5},
+			"backoff":  {InitialDelay: time.Second, Multiplier: 2},
+			"jitter":   {Jitter: 0.5, MaxAge: time.Hour},
+		},
+	}
+
+	tests := []struct {
+		via  string
+		want retryPolicy
+	}{
+		{"unknown", c.Policy},
+		{"attempts", retryPolicy{Sequence: seq, Jitter: 0.1, MaxAttempts: 5, MaxAge: 72 * time.Hour}},
+		{"backoff", retryPolicy{InitialDelay: time.Second, Multiplier: 2, Jitter: 0.1,
+			MaxAttempts: 20, MaxAge: 72 * time.Hour}},
+		{"jitter", retryPolicy{Sequence: seq, Jitter: 0.5, MaxAttempts: 20, MaxAge: time.Hour}},
+	}
+	for _, test := range tests {
+		got := c.policyFor(test.via)
+		if len(got.Sequence) != len(test.want.Sequence) || got.InitialDelay != test.want.InitialDelay ||
+			got.Multiplier != test.want.Multiplier || got.Jitter != test.want.Jitter ||
+			got.MaxAttempts != test.want.MaxAttempts || got.MaxAge != test.want.MaxAge {
+			t.Errorf("%s: got %+v, want %+v", test.via, got, test.want)
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	seq := retryPolicy{Sequence: []time.Duration{time.Minute, 2 * time.Minute}}
+	backoff := retryPolicy{InitialDelay: time.Second, Multiplier: 3}
+	constant := retryPolicy{InitialDelay: time.Second}
+
+	tests := []struct {
+		name    string
+		policy  retryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"sequence first", seq, 1, time.Minute},
+		{"sequence below 1", seq, 0, time.Minute},
+		{"sequence second", seq, 2, 2 * time.Minute},
+		{"sequence past the end", seq, 5, 2 * time.Minute},
+		{"backoff first", backoff, 1, time.Second},
+		{"backoff third", backoff, 3, 9 * time.Second},
+		{"no multiplier", constant, 4, time.Second},
+	}
+	for _, test := range tests {
+		if got := test.policy.delay(test.attempt); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	d := time.Hour
+	p := retryPolicy{Jitter: 0.2}
+
+	if got := (retryPolicy{}).jitter("id", 1, d); got != 0 {
+		t.Errorf("no jitter: got %v, want 0", got)
+	}
+	if got := p.jitter("id", 1, 0); got != 0 {
+		t.Errorf("no delay: got %v, want 0", got)
+	}
+	for attempt := 1; attempt <= 20; attempt++ {
+		got := p.jitter("id", attempt, d)
+		if got < -12*time.Minute || got > 12*time.Minute {
+			t.Errorf("attempt %d: %v out of +/-12m", attempt, got)
+		}
+		if again := p.jitter("id", attempt, d); again != got {
+			t.Errorf("attempt %d: not stable, got %v then %v", attempt, got, again)
+		}
+	}
+}
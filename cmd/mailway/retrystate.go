@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	RETRY_STATE_LOCATION = path.Join(config.RUNTIME_LOCATION, "meta")
+	// how long the state of an email that left the queue is kept around in
+	// case the services buffer it again
+	RETRY_STATE_TTL = 24 * time.Hour
+)
+
+type retryAttempt struct {
+	At       time.Time `json:"at"`
+	Response string    `json:"response"`
+}
+
+// retryState is the retry history of a queued email, stored in a sidecar
+// file so that it survives the file being touched, copied or buffered again
+type retryState struct {
+	Id        string         `json:"id"`
+	MailIds   []string       `json:"mail_ids"`
+	FirstSeen time.Time      `json:"first_seen"`
+	Attempts  []retryAttempt `json:"attempts"`
+	NextDue   *time.Time     `json:"next_due,omitempty"`
+}
+
+func retryStatePath(id string) string {
+	return path.Join(RETRY_STATE_LOCATION, id+".json")
+}
+
+// mailIds returns the Mw-Int-Id added by the services each time the email
+// went through them
+func mailIds(header mail.Header) []string {
+	return header["Mw-Int-Id"]
+}
+
+func readRetryState(id string) (*retryState, error) {
+	data, err := ioutil.ReadFile(retryStatePath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read retry state")
+	}
+	var state retryState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Wrap(err, "could not parse retry state")
+	}
+	return &state, nil
+}
+
+func (s *retryState) save() error {
+	if err := os.MkdirAll(RETRY_STATE_LOCATION, 0755); err != nil {
+		return errors.Wrapf(err, "could not create %s", RETRY_STATE_LOCATION)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "could not encode retry state")
+	}
+
+	dest := retryStatePath(s.Id)
+	tmp := dest + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "could not write retry state")
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return errors.Wrap(err, "could not write retry state")
+	}
+	return nil
+}
+
+func deleteRetryState(id string) error {
+	err := os.Remove(retryStatePath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not delete retry state")
+	}
+	return nil
+}
+
+// retries returns the number of the next attempt, starting at 1
+func (s *retryState) retries() int {
+	return len(s.Attempts) + 1
+}
+
+func (s *retryState) lastAttempt() time.Time {
+	if len(s.Attempts) == 0 {
+		return s.FirstSeen
+	}
+	return s.Attempts[len(s.Attempts)-1].At
+}
+
+func (s *retryState) lastResponse() string {
+	if len(s.Attempts) == 0 {
+		return ""
+	}
+	return s.Attempts[len(s.Attempts)-1].Response
+}
+
+func (s *retryState) recordAttempt(err error) {
+	response := "ok"
+	if err != nil {
+		response = err.Error()
+	}
+	s.Attempts = append(s.Attempts, retryAttempt{
+		At:       time.Now(),
+		Response: response,
+	})
+}
+
+func isQueued(id string) bool {
+	return fileExists(path.Join(config.RUNTIME_LOCATION, id)) ||
+		fileExists(path.Join(QUEUE_HOLD_LOCATION, id)) ||
+		fileExists(path.Join(DEAD_LETTER_LOCATION, id)) ||
+		fileExists(path.Join(QUARANTINE_LOCATION, id))
+}
+
+// loadOrphanRetryStates returns, by Mw-Int-Id, the states of emails that left
+// the queue recently. States older than RETRY_STATE_TTL are deleted.
+func loadOrphanRetryStates() (map[string]*retryState, error) {
+	return scanOrphanRetryStates(true)
+}
+
+// peekOrphanRetryStates is loadOrphanRetryStates without deleting anything,
+// for the queue tooling
+func peekOrphanRetryStates() (map[string]*retryState, error) {
+	return scanOrphanRetryStates(false)
+}
+
+func scanOrphanRetryStates(deleteExpired bool) (map[string]*retryState, error) {
+	orphans := make(map[string]*retryState)
+	files, err := ioutil.ReadDir(RETRY_STATE_LOCATION)
+	if os.IsNotExist(err) {
+		return orphans, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", RETRY_STATE_LOCATION)
+	}
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(file.Name(), ".json")
+		if isQueued(id) {
+			continue
+		}
+		if time.Since(file.ModTime()) > RETRY_STATE_TTL {
+			if deleteExpired {
+				log.Debugf("deleting expired retry state of %s", id)
+				if err := deleteRetryState(id); err != nil {
+					log.Warn(err)
+				}
+			}
+			continue
+		}
+
+		state, err := readRetryState(id)
+		if err != nil || state == nil {
+			log.Warnf("ignoring retry state of %s: %s", id, err)
+			continue
+		}
+		for _, mailId := range state.MailIds {
+			orphans[mailId] = state
+		}
+	}
+	return orphans, nil
+}
+
+// findOrphan returns the state of a previous buffer of the email
+func findOrphan(header mail.Header, orphans map[string]*retryState) *retryState {
+	for _, mailId := range mailIds(header) {
+		if orphan, ok := orphans[mailId]; ok {
+			return orphan
+		}
+	}
+	return nil
+}
+
+func newRetryState(id string, header mail.Header, modTime time.Time) *retryState {
+	ids := mailIds(header)
+	state := &retryState{
+		Id:        id,
+		MailIds:   ids,
+		FirstSeen: modTime,
+		Attempts:  make([]retryAttempt, 0),
+	}
+	// emails buffered before retry states existed; every Mw-Int-Id past the
+	// first one is a previous attempt
+	for i := 1; i < len(ids); i++ {
+		state.Attempts = append(state.Attempts, retryAttempt{
+			At:       modTime,
+			Response: "imported from Mw-Int-Id headers",
+		})
+	}
+	return state
+}
+
+// getRetryState returns the retry state of a queued email. If the email has
+// none yet, it takes over the state of a previous buffer of the same email
+// found in orphans (see loadOrphanRetryStates) or starts a new one.
+func getRetryState(id string, header mail.Header, modTime time.Time,
+	orphans map[string]*retryState) (*retryState, error) {
+	state, err := readRetryState(id)
+	if err != nil {
+		return nil, err
+	}
+	if state != nil {
+		return state, nil
+	}
+
+	if orphan := findOrphan(header, orphans); orphan != nil {
+		log.Debugf("%s is a new buffer of %s", id, orphan.Id)
+		oldId := orphan.Id
+		for _, mailId := range orphan.MailIds {
+			delete(orphans, mailId)
+		}
+		orphan.Id = id
+		orphan.MailIds = mailIds(header)
+		if err := orphan.save(); err != nil {
+			return nil, err
+		}
+		if err := deleteRetryState(oldId); err != nil {
+			log.Warn(err)
+		}
+		return orphan, nil
+	}
+
+	state = newRetryState(id, header, modTime)
+	if err := state.save(); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// peekRetryState returns the retry state the retrier would use for a queued
+// email, without saving or deleting anything; creating states and taking
+// over orphans is left to the retrier
+func peekRetryState(id string, header mail.Header, modTime time.Time,
+	orphans map[string]*retryState) (*retryState, error) {
+	state, err := readRetryState(id)
+	if err != nil || state != nil {
+		return state, err
+	}
+	if orphan := findOrphan(header, orphans); orphan != nil {
+		state := *orphan
+		state.Id = id
+		state.MailIds = mailIds(header)
+		return &state, nil
+	}
+	return newRetryState(id, header, modTime), nil
+}
@@ -98,12 +98,13 @@ func setupConnected(ip *net.IP, dkim string) error {
 				panic(err)
 			}
 
-			if err := generateFrontlineConf(); err != nil {
-				return errors.Wrap(err, "could not generate frontline conf")
-			}
+			// nginx refuses a config whose certificates are missing
 			if err := generateHTTPCert(); err != nil {
 				return errors.Wrap(err, "could not generate certificates for HTTP")
 			}
+			if err := generateFrontlineConf(frontlineOptions{}); err != nil {
+				return errors.Wrap(err, "could not generate frontline conf")
+			}
 
 			log.Info("Setup completed; starting email service")
 			services("start")
@@ -151,7 +152,7 @@ func setupLocal(ip *net.IP, dkim string) error {
 		return errors.Wrap(err, "could not write instance config")
 	}
 
-	if err := generateFrontlineConf(); err != nil {
+	if err := generateFrontlineConf(frontlineOptions{}); err != nil {
 		return errors.Wrap(err, "could not generate frontline conf")
 	}
 
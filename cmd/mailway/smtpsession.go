@@ -0,0 +1,369 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// sessions unused for longer are closed
+	SMTP_SESSION_IDLE_TIMEOUT = 30 * time.Second
+	// a new session is opened after that many emails
+	SMTP_SESSION_MAX_EMAILS = 1000
+	// how long sending one email can take
+	SMTP_SESSION_IO_TIMEOUT = 5 * time.Minute
+
+	smtpSessions = newSMTPSessionPool()
+)
+
+// smtpSession is a connection to a local service that can send several
+// emails, one after the other
+type smtpSession struct {
+	addr     string
+	conn     net.Conn
+	text     *textproto.Conn
+	ext      map[string]string
+	sent     int
+	lastUsed time.Time
+}
+
+func dialSMTPSession(addr string) (*smtpSession, error) {
+	conn, err := net.DialTimeout("tcp", addr, VIA_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(VIA_DIAL_TIMEOUT)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s := &smtpSession{
+		addr: addr,
+		conn: conn,
+		text: textproto.NewConn(conn),
+	}
+	if _, _, err := s.text.ReadResponse(220); err != nil {
+		s.text.Close()
+		return nil, err
+	}
+	if err := s.hello(); err != nil {
+		s.text.Close()
+		return nil, err
+	}
+
+	if _, ok := s.ext["STARTTLS"]; ok {
+		if err := s.cmd(220, "STARTTLS"); err != nil {
+			s.text.Close()
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		s.conn = tlsConn
+		s.text = textproto.NewConn(tlsConn)
+		if err := s.hello(); err != nil {
+			s.text.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *smtpSession) cmd(expectCode int, format string, args ...interface{}) error {
+	id, err := s.text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	s.text.StartResponse(id)
+	defer s.text.EndResponse(id)
+	_, _, err = s.text.ReadResponse(expectCode)
+	return err
+}
+
+// hello greets the server and records the extensions it supports
+func (s *smtpSession) hello() error {
+	s.ext = make(map[string]string)
+	id, err := s.text.Cmd("EHLO localhost")
+	if err != nil {
+		return err
+	}
+	s.text.StartResponse(id)
+	_, msg, err := s.text.ReadResponse(250)
+	s.text.EndResponse(id)
+	if err != nil {
+		// not ESMTP
+		return s.cmd(250, "HELO localhost")
+	}
+
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		args := strings.SplitN(line, " ", 2)
+		if len(args) > 1 {
+			s.ext[strings.ToUpper(args[0])] = args[1]
+		} else {
+			s.ext[strings.ToUpper(args[0])] = ""
+		}
+	}
+	return nil
+}
+
+// envelope sends MAIL FROM and the RCPT TO commands, all at once when the
+// server supports pipelining. It returns the rejected recipients.
+func (s *smtpSession) envelope(from string, to []string) (map[string]error, error) {
+	rejected := make(map[string]error)
+
+	if _, ok := s.ext["PIPELINING"]; !ok {
+		if err := s.cmd(250, "MAIL FROM:<%s>", from); err != nil {
+			return nil, err
+		}
+		for _, rcpt := range to {
+			if err := s.cmd(25, "RCPT TO:<%s>", rcpt); err != nil {
+				if _, ok := err.(*textproto.Error); !ok {
+					return nil, err
+				}
+				rejected[rcpt] = err
+			}
+		}
+		return rejected, nil
+	}
+
+	ids := make([]uint, 0, len(to)+1)
+	id, err := s.text.Cmd("MAIL FROM:<%s>", from)
+	if err != nil {
+		return nil, err
+	}
+	ids = append(ids, id)
+	for _, rcpt := range to {
+		id, err := s.text.Cmd("RCPT TO:<%s>", rcpt)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	// replies come back in order; all of them have to be read even if the
+	// sender was rejected
+	var mailErr error
+	for i, id := range ids {
+		s.text.StartResponse(id)
+		expectCode := 25
+		if i == 0 {
+			expectCode = 250
+		}
+		_, _, err := s.text.ReadResponse(expectCode)
+		s.text.EndResponse(id)
+		if err == nil {
+			continue
+		}
+		if _, ok := err.(*textproto.Error); !ok {
+			return nil, err
+		}
+		if i == 0 {
+			mailErr = err
+			continue
+		}
+		rejected[to[i-1]] = err
+	}
+	if mailErr != nil {
+		return nil, mailErr
+	}
+	return rejected, nil
+}
+
+// send delivers one email, the session is left ready for the next one
+func (s *smtpSession) send(from string, to []string, data []byte) (map[string]error, error) {
+	s.lastUsed = time.Now()
+	if err := s.conn.SetDeadline(s.lastUsed.Add(SMTP_SESSION_IO_TIMEOUT)); err != nil {
+		return nil, err
+	}
+
+	rejected, err := s.envelope(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(rejected) == len(to) {
+		return rejected, nil
+	}
+
+	if err := s.cmd(354, "DATA"); err != nil {
+		return nil, err
+	}
+	w := s.text.DotWriter()
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if _, _, err := s.text.ReadResponse(250); err != nil {
+		return nil, err
+	}
+	s.sent++
+	return rejected, nil
+}
+
+// reset aborts any transaction left over; it also makes sure that the
+// server didn't close the connection in the meantime
+func (s *smtpSession) reset() error {
+	if err := s.conn.SetDeadline(time.Now().Add(VIA_DIAL_TIMEOUT)); err != nil {
+		return err
+	}
+	return s.cmd(250, "RSET")
+}
+
+func (s *smtpSession) close() {
+	s.conn.SetDeadline(time.Now().Add(VIA_DIAL_TIMEOUT))
+	if err := s.cmd(221, "QUIT"); err != nil {
+		log.Debugf("QUIT to %s failed: %s", s.addr, err)
+	}
+	s.text.Close()
+}
+
+// smtpSessionPool keeps the sessions to the local services open between
+// emails, by address
+type smtpSessionPool struct {
+	sync.Mutex
+	idle map[string][]*smtpSession
+	// sessions sending an email
+	active map[*smtpSession]bool
+}
+
+func newSMTPSessionPool() *smtpSessionPool {
+	return &smtpSessionPool{
+		idle:   make(map[string][]*smtpSession),
+		active: make(map[*smtpSession]bool),
+	}
+}
+
+// get returns an idle session to addr or opens a new one
+func (p *smtpSessionPool) get(addr string) (*smtpSession, error) {
+	for {
+		p.Lock()
+		sessions := p.idle[addr]
+		if len(sessions) == 0 {
+			p.Unlock()
+			break
+		}
+		s := sessions[len(sessions)-1]
+		p.idle[addr] = sessions[:len(sessions)-1]
+		p.Unlock()
+
+		if time.Since(s.lastUsed) > SMTP_SESSION_IDLE_TIMEOUT {
+			s.close()
+			continue
+		}
+		if err := s.reset(); err != nil {
+			log.Debugf("session to %s unusable: %s", addr, err)
+			s.text.Close()
+			continue
+		}
+		p.setActive(s, true)
+		return s, nil
+	}
+
+	s, err := dialSMTPSession(addr)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("new SMTP session to %s", addr)
+	p.setActive(s, true)
+	return s, nil
+}
+
+func (p *smtpSessionPool) setActive(s *smtpSession, active bool) {
+	p.Lock()
+	defer p.Unlock()
+	if active {
+		p.active[s] = true
+	} else {
+		delete(p.active, s)
+	}
+}
+
+// abort interrupts the emails being sent; the server drops the unfinished
+// transactions
+func (p *smtpSessionPool) abort() {
+	p.Lock()
+	defer p.Unlock()
+	for s := range p.active {
+		s.conn.SetDeadline(time.Now())
+	}
+}
+
+// put gives back a session that can be used for another email
+func (p *smtpSessionPool) put(s *smtpSession) {
+	if s.sent >= SMTP_SESSION_MAX_EMAILS {
+		s.close()
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.idle[s.addr] = append(p.idle[s.addr], s)
+}
+
+// closeIdle closes the sessions unused for longer than maxIdle
+func (p *smtpSessionPool) closeIdle(maxIdle time.Duration) {
+	p.Lock()
+	expired := make([]*smtpSession, 0)
+	for addr, sessions := range p.idle {
+		kept := sessions[:0]
+		for _, s := range sessions {
+			if time.Since(s.lastUsed) >= maxIdle {
+				expired = append(expired, s)
+			} else {
+				kept = append(kept, s)
+			}
+		}
+		p.idle[addr] = kept
+	}
+	p.Unlock()
+
+	for _, s := range expired {
+		s.close()
+	}
+}
+
+// deliverSMTP sends the email using a pooled session to addr
+func deliverSMTP(addr string, from string, to []string, data []byte) (map[string]error, error) {
+	s, err := smtpSessions.get(addr)
+	if err != nil {
+		return nil, err
+	}
+	rejected, err := s.send(from, to, data)
+	smtpSessions.setActive(s, false)
+	if err != nil {
+		// the server replied; the session is still usable
+		if _, ok := err.(*textproto.Error); ok {
+			smtpSessions.put(s)
+		} else {
+			s.text.Close()
+		}
+		return nil, err
+	}
+	smtpSessions.put(s)
+	return rejected, nil
+}
+
+// sendMailout sends an email generated by mailway itself through mailout,
+// with the same timeouts as the retries
+func sendMailout(from string, to []string, data []byte) error {
+	rejected, err := deliverSMTP(localAddr(config.CurrConfig.PortMailout), from, to, data)
+	if err != nil {
+		return err
+	}
+	for rcpt, err := range rejected {
+		return errors.Wrapf(err, "%s rejected", rcpt)
+	}
+	return nil
+}
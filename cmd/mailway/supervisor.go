@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"io/ioutil"
+	"net/mail"
 	"os"
-	"path"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mailway-app/config"
@@ -15,94 +19,228 @@ import (
 
 var (
 	JWT_CHECK_INTERVAL = 1 * time.Hour
-
-	MAILOUT_RETRY_INTERVAL = 3 * time.Minute
-	MAILWAY_RETRY_SEQ      = []int{-1, 0, 1, 1, 2, 3, 5, 8, 13, 21, 34, 55, 89, 144,
-		233, 377, 610, 987, 1597, 2584, 4181}
+	// how long to wait before starting the retrier again after it stopped
+	RETRIER_RESTART_DELAY = 1 * time.Minute
+	// how long to wait for the emails being retried when stopping
+	SHUTDOWN_TIMEOUT = 30 * time.Second
 )
 
 func supervise() error {
-	done := make(chan interface{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	var wg sync.WaitGroup
+	reload := make(chan struct{}, 1)
 
 	if !config.CurrConfig.IsInstanceLocal() {
+		wg.Add(1)
 		go func() {
-			if err := superviseServerJWT(); err != nil {
-				log.Fatalf("failed to supervise server JWT: %s", err)
-			}
+			defer wg.Done()
+			superviseServerJWT(ctx)
 		}()
 	}
+	wg.Add(1)
 	go func() {
-		if err := superviseMailoutRetrier(); err != nil {
-			log.Fatalf("failed to supervise mailout retrier: %s", err)
+		defer wg.Done()
+		// the retrier failing must not take down the rest of the supervisor
+		for {
+			err := superviseMailoutRetrier(ctx, reload)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Errorf("mailout retrier stopped: %s; restarting in %v",
+				err, RETRIER_RESTART_DELAY)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(RETRIER_RESTART_DELAY):
+			}
 		}
 	}()
 
-	<-done
-	return nil
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		superviseServices(ctx)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		superviseCertificates(ctx)
+	}()
+
+	if c, err := loadSupervisorConfig(); err != nil {
+		log.Errorf("metrics disabled: %s", err)
+	} else if c.MetricsPort > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serveMetrics(ctx, c.MetricsPort); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		log.Warn(err)
+	}
+	var watchdog <-chan time.Time
+	if interval := sdWatchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
+	for {
+		select {
+		case <-watchdog:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				log.Warn(err)
+			}
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				log.Info("reloading configuration")
+				sdNotify("RELOADING=1")
+				// conf.d is reloaded by the config package as it changes
+				log.SetLevel(config.CurrConfig.GetLogLevel())
+				smtpSessions.closeIdle(0)
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+				sdNotify("READY=1")
+				continue
+			}
+
+			log.Infof("received %s; shutting down", sig)
+			sdNotify("STOPPING=1")
+			cancel()
+			wg.Wait()
+			smtpSessions.closeIdle(0)
+			log.Info("supervisor stopped")
+			return nil
+		}
+	}
 }
 
-func getNextRetry(modTime time.Time, retry int) (time.Time, error) {
-	if retry > len(MAILWAY_RETRY_SEQ) {
-		return time.Time{}, errors.Errorf("too many retries (%d), ignoring", retry)
+// retryOutcome is what became of an email the retrier tried to send back
+type retryOutcome int
+
+const (
+	// still in the queue; the error tells why
+	retryQueued retryOutcome = iota
+	retrySent
+	retryDeadLettered
+	retryQuarantined
+)
+
+func (o retryOutcome) String() string {
+	switch o {
+	case retrySent:
+		return "sent"
+	case retryDeadLettered:
+		return "dead-lettered"
+	case retryQuarantined:
+		return "quarantined"
 	}
-	n := time.Duration(MAILWAY_RETRY_SEQ[retry]) * 3 * time.Minute
-	return modTime.Add(n), nil
+	return "queued"
 }
 
-func retryCount(data []byte) int {
-	return strings.Count(string(data), "Mw-Int-Id")
+// parked returns the outcome of moving an email out of the queue; if the
+// move failed the email is still queued
+func parked(outcome retryOutcome, err error) (retryOutcome, error) {
+	if err != nil {
+		return retryQueued, err
+	}
+	return outcome, nil
 }
 
-func superviseMailoutRetrier() error {
-	log.Info("mailout retrier running")
-	for range time.Tick(MAILOUT_RETRY_INTERVAL) {
-		files, err := ioutil.ReadDir(config.RUNTIME_LOCATION)
-		if err != nil {
-			return errors.Wrapf(err, "failed to read %s", config.RUNTIME_LOCATION)
-		}
+// retryEmail sends a buffered email back into the system. The file is locked
+// for the duration of the attempt; errQueueFileLocked is returned if another
+// process is already working on it. Emails that failed temporarily stay in
+// the queue and the error is returned; otherwise the outcome tells whether
+// the email was sent or set aside.
+func retryEmail(abspath string, conf *retryConfig) (retryOutcome, error) {
+	unlock, err := lockQueueFile(abspath)
+	if err != nil {
+		return retryQueued, err
+	}
+	defer unlock()
 
-		for _, file := range files {
-			abspath := path.Join(config.RUNTIME_LOCATION, file.Name())
-			data, err := ioutil.ReadFile(abspath)
-			if err != nil {
-				return errors.Wrap(err, "could not read file")
-			}
+	err = recoverEmail(abspath, recoverOptions{Retry: conf})
+	switch e := err.(type) {
+	case nil:
+		return retrySent, nil
+	case *permanentError:
+		log.Errorf("failed to recover email: %s", err)
+		return parked(retryDeadLettered, failEmail(abspath, e.failure(), !e.notified))
+	case *unknownViaError:
+		return parked(retryQuarantined, moveToQuarantine(abspath, err.Error()))
+	case *loopError:
+		log.Warnf("%s: %s", abspath, err)
+		return parked(retryQuarantined, moveToQuarantine(abspath, err.Error()))
+	case *badEmailError:
+		return parked(retryQuarantined, moveToQuarantine(abspath, err.Error()))
+	}
+	return retryQueued, err
+}
 
-			// ensures that the file has been in the queue for long enough
-			if time.Since(file.ModTime()) < MAILOUT_RETRY_INTERVAL {
-				continue
-			}
+// giveUpEmail moves an email that won't be retried anymore out of the queue
+func giveUpEmail(abspath string, reason string) error {
+	unlock, err := lockQueueFile(abspath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-			retryCount := retryCount(data)
-			nextRetry, err := getNextRetry(file.ModTime(), retryCount)
-			if err != nil {
-				log.Errorf("could not retry: %s", err)
-				continue
-			}
+	return failEmail(abspath, retriesExhaustedFailure(reason), true)
+}
 
-			if nextRetry.Before(time.Now()) {
-				log.Infof("%s retried %d time(s), retyring now", abspath, retryCount)
-				if err := recoverEmail(abspath); err != nil {
-					log.Errorf("failed to recover email: %s", err)
+// quarantineEmail moves an email the retrier can't process out of the queue
+func quarantineEmail(abspath string, reason string) error {
+	unlock, err := lockQueueFile(abspath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-					// delete the email since a new buffer will be created from
-					// the failure
-					if err := os.Remove(abspath); err != nil {
-						return errors.Wrap(err, "could not delete file")
-					}
-				}
-			} else {
-				log.Infof("%s retried %d time(s) next retry in %v",
-					abspath, retryCount, time.Until(nextRetry))
-			}
+	return moveToQuarantine(abspath, reason)
+}
+
+// failEmail notifies the sender, unless notify is false, and moves the email
+// to the dead letters. The caller must hold the lock on the file.
+func failEmail(abspath string, failure deliveryFailure, notify bool) error {
+	if notify {
+		data, err := ioutil.ReadFile(abspath)
+		if err != nil {
+			return errors.Wrap(err, "could not read file")
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			return errors.Wrap(err, "could not read message")
+		}
+		if err := sendDSN(data, failure.forAll(msg.Header)); err != nil {
+			log.Errorf("could not notify sender: %s", err)
 		}
 	}
-	return nil
+	return moveToDeadLetter(abspath, failure.Reason)
 }
 
-func superviseServerJWT() error {
+func superviseServerJWT(ctx context.Context) {
 	log.Info("server JWT watcher running")
-	for range time.Tick(JWT_CHECK_INTERVAL) {
+	ticker := time.NewTicker(JWT_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
 		token := config.CurrConfig.ServerJWT
 		if token == "" {
 			log.Warn("no existing token; did you forgot to run mailway setup?")
@@ -133,6 +271,4 @@ func superviseServerJWT() error {
 		}
 
 	}
-
-	return nil
 }
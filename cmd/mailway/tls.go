@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	TLS_VERSIONS = []string{"TLSv1", "TLSv1.1", "TLSv1.2", "TLSv1.3"}
+
+	// based on Mozilla's server side TLS recommendations; the DHE suites
+	// are left out since we don't generate DH parameters
+	TLS_PRESETS = map[string]tlsSettings{
+		"modern": {
+			MinVersion:       "TLSv1.3",
+			ECDHCurves:       []string{"X25519", "prime256v1", "secp384r1"},
+			SessionTimeout:   "1d",
+			SessionCacheSize: "50m",
+			OCSPStapling:     true,
+			HSTSMaxAge:       63072000,
+		},
+		"intermediate": {
+			MinVersion: "TLSv1.2",
+			Ciphers: []string{
+				"ECDHE-ECDSA-AES128-GCM-SHA256",
+				"ECDHE-RSA-AES128-GCM-SHA256",
+				"ECDHE-ECDSA-AES256-GCM-SHA384",
+				"ECDHE-RSA-AES256-GCM-SHA384",
+				"ECDHE-ECDSA-CHACHA20-POLY1305",
+				"ECDHE-RSA-CHACHA20-POLY1305",
+			},
+			ECDHCurves:       []string{"X25519", "prime256v1", "secp384r1"},
+			SessionTimeout:   "1d",
+			SessionCacheSize: "50m",
+			OCSPStapling:     true,
+			HSTSMaxAge:       63072000,
+		},
+		// what frontline used to accept, for clients that can't do better
+		"legacy": {
+			MinVersion:       "TLSv1",
+			SessionTimeout:   "1d",
+			SessionCacheSize: "50m",
+		},
+	}
+)
+
+// tls.yml in conf.d; anything set overrides the preset
+type tlsConfig struct {
+	Preset              string   `yaml:"tls_preset"`
+	MinVersion          string   `yaml:"tls_min_version"`
+	Ciphers             []string `yaml:"tls_ciphers"`
+	ECDHCurves          []string `yaml:"tls_ecdh_curves"`
+	PreferServerCiphers *bool    `yaml:"tls_prefer_server_ciphers"`
+	SessionTimeout      string   `yaml:"tls_session_timeout"`
+	SessionCacheSize    string   `yaml:"tls_session_cache_size"`
+	SessionTickets      *bool    `yaml:"tls_session_tickets"`
+	OCSPStapling        *bool    `yaml:"tls_ocsp_stapling"`
+	HSTSMaxAge          *int     `yaml:"tls_hsts_max_age"`
+}
+
+// tlsSettings is the policy rendered into every TLS listener of frontline
+type tlsSettings struct {
+	MinVersion          string
+	Ciphers             []string
+	ECDHCurves          []string
+	PreferServerCiphers bool
+	SessionTimeout      string
+	SessionCacheSize    string
+	SessionTickets      bool
+	// HTTPS only; the mail module has neither
+	OCSPStapling bool
+	HSTSMaxAge   int
+}
+
+func loadTLSSettings() (*tlsSettings, error) {
+	c := tlsConfig{Preset: "intermediate"}
+	if err := loadConf(&c); err != nil {
+		return nil, errors.Wrap(err, "could not load TLS config")
+	}
+	preset, ok := TLS_PRESETS[c.Preset]
+	if !ok {
+		return nil, errors.Errorf("unknown tls_preset %q", c.Preset)
+	}
+
+	s := preset
+	if c.MinVersion != "" {
+		s.MinVersion = c.MinVersion
+	}
+	if c.Ciphers != nil {
+		s.Ciphers = c.Ciphers
+	}
+	if c.ECDHCurves != nil {
+		s.ECDHCurves = c.ECDHCurves
+	}
+	if c.PreferServerCiphers != nil {
+		s.PreferServerCiphers = *c.PreferServerCiphers
+	}
+	if c.SessionTimeout != "" {
+		s.SessionTimeout = c.SessionTimeout
+	}
+	if c.SessionCacheSize != "" {
+		s.SessionCacheSize = c.SessionCacheSize
+	}
+	if c.SessionTickets != nil {
+		s.SessionTickets = *c.SessionTickets
+	}
+	if c.OCSPStapling != nil {
+		s.OCSPStapling = *c.OCSPStapling
+	}
+	if c.HSTSMaxAge != nil {
+		s.HSTSMaxAge = *c.HSTSMaxAge
+	}
+
+	if s.Protocols() == "" {
+		return nil, errors.Errorf("unknown tls_min_version %q; expected one of %s",
+			s.MinVersion, strings.Join(TLS_VERSIONS, ", "))
+	}
+	return &s, nil
+}
+
+// Protocols lists the versions from the minimum up, for ssl_protocols
+func (s *tlsSettings) Protocols() string {
+	for i, version := range TLS_VERSIONS {
+		if version == s.MinVersion {
+			return strings.Join(TLS_VERSIONS[i:], " ")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	VIA_DIAL_TIMEOUT = 10 * time.Second
+
+	// services the email can be sent back to, by Mw-Int-Via
+	BUILTIN_VIA_HANDLERS = map[string]func() viaHandler{
+		"forwarding": func() viaHandler {
+			return &smtpHandler{addr: localAddr(config.CurrConfig.PortForwarding)}
+		},
+		"responder": func() viaHandler {
+			return &smtpHandler{addr: localAddr(config.CurrConfig.PortResponder)}
+		},
+		"mailout": func() viaHandler {
+			return &smtpHandler{addr: localAddr(config.CurrConfig.PortMailout)}
+		},
+		"webhooks": func() viaHandler {
+			return &smtpHandler{addr: localAddr(config.CurrConfig.PortWebhook)}
+		},
+		"maildb": func() viaHandler {
+			return &httpHandler{
+				url: fmt.Sprintf("http://%s/db/", localAddr(config.CurrConfig.PortMaildb)),
+			}
+		},
+	}
+)
+
+// viaHandler delivers a recovered email to the service that buffered it. If
+// the transaction failed as a whole an error is returned, otherwise the
+// recipients that were rejected are returned with their error.
+type viaHandler interface {
+	deliver(from string, to []string, data []byte) (map[string]error, error)
+	// where the email is sent
+	String() string
+}
+
+// user defined target in via.yml
+type viaTarget struct {
+	// smtp, lmtp or http
+	Type string `yaml:"type"`
+	// host:port for smtp and lmtp
+	Address string `yaml:"address"`
+	// endpoint receiving the email as message/rfc822 for http
+	URL string `yaml:"url"`
+}
+
+// via.yml in conf.d
+type viaConfig struct {
+	Handlers map[string]viaTarget `yaml:"via_handlers"`
+}
+
+// unknownViaError is returned when no handler exists for the email's via
+type unknownViaError struct {
+	Via string
+}
+
+func (e *unknownViaError) Error() string {
+	if e.Via == "" {
+		return "email has no Mw-Int-Via header"
+	}
+	return fmt.Sprintf("no handler for via %q", e.Via)
+}
+
+func localAddr(port int) string {
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
+
+func (t viaTarget) handler() (viaHandler, error) {
+	switch t.Type {
+	case "smtp", "":
+		if t.Address == "" {
+			return nil, errors.New("missing address")
+		}
+		return &smtpHandler{addr: t.Address}, nil
+	case "lmtp":
+		if t.Address == "" {
+			return nil, errors.New("missing address")
+		}
+		return &lmtpHandler{addr: t.Address}, nil
+	case "http":
+		if t.URL == "" {
+			return nil, errors.New("missing url")
+		}
+		return &httpHandler{url: t.URL}, nil
+	}
+	return nil, errors.Errorf("unknown type %q", t.Type)
+}
+
+func loadViaConfig() (*viaConfig, error) {
+	var c viaConfig
+	if err := loadConf(&c); err != nil {
+		return nil, errors.Wrap(err, "could not load via config")
+	}
+	return &c, nil
+}
+
+// lookup returns the handler for the via; the ones defined in via.yml take
+// precedence over the builtin ones
+func (c *viaConfig) lookup(via string) (viaHandler, error) {
+	if target, ok := c.Handlers[via]; ok {
+		h, err := target.handler()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid via_handlers.%s", via)
+		}
+		return h, nil
+	}
+	if newHandler, ok := BUILTIN_VIA_HANDLERS[via]; ok {
+		return newHandler(), nil
+	}
+	return nil, &unknownViaError{via}
+}
+
+type smtpHandler struct {
+	addr string
+}
+
+func (h *smtpHandler) String() string {
+	return "smtp://" + h.addr
+}
+
+func (h *smtpHandler) deliver(from string, to []string, data []byte) (map[string]error, error) {
+	return deliverSMTP(h.addr, from, to, data)
+}
+
+type lmtpHandler struct {
+	addr string
+}
+
+func (h *lmtpHandler) String() string {
+	return "lmtp://" + h.addr
+}
+
+func (h *lmtpHandler) deliver(from string, to []string, data []byte) (map[string]error, error) {
+	conn, err := net.DialTimeout("tcp", h.addr, VIA_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	text := textproto.NewConn(conn)
+	defer text.Close()
+
+	cmd := func(expectCode int, format string, args ...interface{}) error {
+		id, err := text.Cmd(format, args...)
+		if err != nil {
+			return err
+		}
+		text.StartResponse(id)
+		defer text.EndResponse(id)
+		_, _, err = text.ReadResponse(expectCode)
+		return err
+	}
+
+	if _, _, err := text.ReadResponse(220); err != nil {
+		return nil, err
+	}
+	if err := cmd(250, "LHLO localhost"); err != nil {
+		return nil, err
+	}
+	if err := cmd(250, "MAIL FROM:<%s>", from); err != nil {
+		return nil, err
+	}
+
+	rejected := make(map[string]error)
+	accepted := make([]string, 0)
+	for _, rcpt := range to {
+		if err := cmd(25, "RCPT TO:<%s>", rcpt); err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return nil, err
+			}
+			rejected[rcpt] = err
+			continue
+		}
+		accepted = append(accepted, rcpt)
+	}
+	if len(accepted) == 0 {
+		return rejected, cmd(221, "QUIT")
+	}
+
+	if err := cmd(354, "DATA"); err != nil {
+		return nil, err
+	}
+	w := text.DotWriter()
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	// LMTP replies once per accepted recipient after the data
+	for _, rcpt := range accepted {
+		if _, _, err := text.ReadResponse(250); err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return nil, err
+			}
+			rejected[rcpt] = err
+		}
+	}
+	return rejected, cmd(221, "QUIT")
+}
+
+type httpHandler struct {
+	url string
+}
+
+func (h *httpHandler) String() string {
+	return h.url
+}
+
+func (h *httpHandler) deliver(from string, to []string, data []byte) (map[string]error, error) {
+	res, err := httpClient.Post(h.url, "message/rfc822", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusOK && res.StatusCode < http.StatusMultipleChoices {
+		return nil, nil
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode >= http.StatusBadRequest && res.StatusCode < http.StatusInternalServerError {
+		return nil, &permanentError{Code: res.StatusCode, Msg: string(bytes.TrimSpace(body))}
+	}
+	return nil, errors.Errorf("HTTP %d: %s", res.StatusCode, bytes.TrimSpace(body))
+}
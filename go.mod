@@ -5,6 +5,7 @@ go 1.13
 require (
 	github.com/asaskevich/govalidator v0.0.0-20200907205600-7a23bdc65eef
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/magefile/mage v1.11.0 // indirect
 	github.com/mailway-app/config v0.0.0-20210513211133-2f31c01469d5
 	github.com/manifoldco/promptui v0.8.0
@@ -13,4 +14,5 @@ require (
 	github.com/spf13/cobra v1.1.3
 	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 	golang.org/x/sys v0.0.0-20210511113859-b0526f3d8744 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )